@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// 各OpenAI兼容接口的请求解析与响应编码，其余流程见 pipeline.go
+
+var chatCompletionsAPI = &apiEndpoint{
+	name:     "chat.completions",
+	idPrefix: "chatcmpl",
+	parse:    parseChatCompletionsRequest,
+	encoder:  chatCompletionsEncoder{},
+}
+
+var responsesAPI = &apiEndpoint{
+	name:     "responses",
+	idPrefix: "chatcmpl",
+	parse:    parseResponsesRequest,
+	encoder:  responsesEncoder{},
+}
+
+var completionsAPI = &apiEndpoint{
+	name:     "completions",
+	idPrefix: "cmpl",
+	parse:    parseCompletionsRequest,
+	encoder:  completionsEncoder{},
+}
+
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	serveAPI(w, r, chatCompletionsAPI)
+}
+
+func handleResponses(w http.ResponseWriter, r *http.Request) {
+	serveAPI(w, r, responsesAPI)
+}
+
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	serveAPI(w, r, completionsAPI)
+}
+
+// Chat Completions API
+
+func parseChatCompletionsRequest(body []byte) (*CanonicalRequest, error) {
+	var req ChatCompletionsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Messages) == 0 {
+		return nil, errors.New("messages must not be empty")
+	}
+
+	// 使用统一的prompt提取函数
+	finalPrompt := extractFinalPrompt(req.Messages)
+	if finalPrompt == "" {
+		// 如果统一函数返回空，使用最后一条消息作为fallback
+		lastMessage := req.Messages[len(req.Messages)-1]
+		finalPrompt = extractTextContent(lastMessage.Content)
+	}
+
+	return &CanonicalRequest{
+		Model:        req.Model,
+		Prompt:       finalPrompt,
+		Stream:       req.Stream != nil && *req.Stream,
+		IncludeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+		MaxTokens:    req.MaxTokens,
+		Temperature:  req.Temperature,
+		Stop:         req.Stop,
+	}, nil
+}
+
+type chatCompletionsEncoder struct{}
+
+func (chatCompletionsEncoder) chunk(resp *CanonicalResponse, choices []StreamChoice) ChatCompletionChunk {
+	return ChatCompletionChunk{
+		ID:      resp.ID,
+		Object:  "chat.completion.chunk",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Choices: choices,
+	}
+}
+
+func (e chatCompletionsEncoder) StreamDelta(resp *CanonicalResponse, text string) []any {
+	return []any{e.chunk(resp, []StreamChoice{{
+		Delta:        Delta{Content: text},
+		FinishReason: nil, // 中间消息的finish_reason为null
+		Index:        0,
+	}})}
+}
+
+func (e chatCompletionsEncoder) StreamEnd(req *CanonicalRequest, resp *CanonicalResponse) []any {
+	finishReason := resp.FinishReason
+	events := []any{e.chunk(resp, []StreamChoice{{
+		Delta:        Delta{},
+		Index:        0,
+		FinishReason: &finishReason,
+	}})}
+	if req.IncludeUsage {
+		// 与OpenAI一致：用量放在choices为空的最后一个块中
+		usageChunk := e.chunk(resp, []StreamChoice{})
+		usageChunk.Usage = &resp.Usage
+		events = append(events, usageChunk)
+	}
+	return events
+}
+
+func (chatCompletionsEncoder) Response(resp *CanonicalResponse) any {
+	finishReason := resp.FinishReason
+	return ChatCompletionsResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Usage:   resp.Usage,
+		Choices: []Choice{
+			{
+				Message: Message{
+					Role:    "assistant",
+					Content: resp.Text,
+				},
+				FinishReason: &finishReason,
+				Index:        0,
+			},
+		},
+	}
+}
+
+// Responses API
+
+func parseResponsesRequest(body []byte) (*CanonicalRequest, error) {
+	var req ResponsesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	// 提取prompt内容，使用统一的prompt提取函数
+	var prompt string
+	switch input := req.Input.(type) {
+	case string:
+		// 简单文本输入
+		prompt = input
+	case []interface{}:
+		// 多模态输入 - 使用统一的prompt提取函数
+		prompt = extractFinalPrompt(input)
+		if prompt == "" {
+			// 如果统一函数返回空，使用原有逻辑作为fallback
+			prompt = firstUserInputText(input)
+		}
+	case nil:
+	default:
+		prompt = fmt.Sprintf("%v", input)
+	}
+
+	return &CanonicalRequest{
+		Model:     req.Model,
+		Prompt:    prompt,
+		Stream:    req.Stream != nil && *req.Stream,
+		MaxTokens: req.MaxOutputTokens,
+		// Responses 流的 response.completed 事件总是附带用量
+		IncludeUsage: true,
+	}, nil
+}
+
+// 返回第一条user消息中第一个 input_text 的文本
+func firstUserInputText(input []interface{}) string {
+	for _, item := range input {
+		msgMap, ok := item.(map[string]interface{})
+		if !ok || msgMap["role"] != "user" {
+			continue
+		}
+		contentArray, ok := msgMap["content"].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, contentItem := range contentArray {
+			contentMap, ok := contentItem.(map[string]interface{})
+			if !ok || contentMap["type"] != "input_text" {
+				continue
+			}
+			if text, ok := contentMap["text"].(string); ok {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+type responsesEncoder struct{}
+
+func (responsesEncoder) StreamDelta(resp *CanonicalResponse, text string) []any {
+	// 转换为统一的 delta 格式
+	return []any{UnifiedStreamChunk{
+		ID:    resp.ID,
+		Type:  "response.output_text.delta",
+		Delta: text,
+	}}
+}
+
+func (responsesEncoder) StreamEnd(req *CanonicalRequest, resp *CanonicalResponse) []any {
+	completed := UnifiedStreamChunk{
+		ID:   resp.ID,
+		Type: "response.completed",
+	}
+	if req.IncludeUsage {
+		completed.Usage = &resp.Usage
+	}
+	return []any{completed}
+}
+
+func (responsesEncoder) Response(resp *CanonicalResponse) any {
+	return ResponsesResponse{
+		ID:      resp.ID,
+		Object:  "response",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Output: []ResponsesOutputMessage{{
+			ID:   "msg_1",
+			Type: "message",
+			Role: "assistant",
+			Content: []ResponsesOutputContent{{
+				Type: "output_text",
+				Text: resp.Text,
+			}},
+		}},
+		Usage: resp.Usage,
+	}
+}
+
+// Completions API
+
+func parseCompletionsRequest(body []byte) (*CanonicalRequest, error) {
+	var req CompletionsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	return &CanonicalRequest{
+		Model:        req.Model,
+		Prompt:       req.Prompt,
+		Stream:       req.Stream != nil && *req.Stream,
+		IncludeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+		MaxTokens:    req.MaxTokens,
+		Temperature:  req.Temperature,
+		Stop:         req.Stop,
+	}, nil
+}
+
+type completionsEncoder struct{}
+
+func (completionsEncoder) chunk(resp *CanonicalResponse, choices []CompletionsStreamChoice) CompletionsStreamChunk {
+	return CompletionsStreamChunk{
+		ID:      resp.ID,
+		Object:  "text_completion",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Choices: choices,
+	}
+}
+
+func (e completionsEncoder) StreamDelta(resp *CanonicalResponse, text string) []any {
+	return []any{e.chunk(resp, []CompletionsStreamChoice{{Text: text}})}
+}
+
+func (e completionsEncoder) StreamEnd(req *CanonicalRequest, resp *CanonicalResponse) []any {
+	finishReason := resp.FinishReason
+	events := []any{e.chunk(resp, []CompletionsStreamChoice{{FinishReason: &finishReason}})}
+	if req.IncludeUsage {
+		usageChunk := e.chunk(resp, []CompletionsStreamChoice{})
+		usageChunk.Usage = &resp.Usage
+		events = append(events, usageChunk)
+	}
+	return events
+}
+
+func (completionsEncoder) Response(resp *CanonicalResponse) any {
+	finishReason := resp.FinishReason
+	return CompletionsResponse{
+		ID:      resp.ID,
+		Object:  "text_completion",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Choices: []CompletionsChoice{{
+			Text:         resp.Text,
+			Index:        0,
+			FinishReason: &finishReason,
+		}},
+		Usage: resp.Usage,
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCompletionsRequest(t *testing.T) {
+	req, err := parseCompletionsRequest([]byte(`{"model":"m","prompt":"hi","max_tokens":5,"stop":"\n","stream":true,"stream_options":{"include_usage":true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Model != "m" || req.Prompt != "hi" || *req.MaxTokens != 5 || !req.Stream || !req.IncludeUsage || !slices.Equal(req.Stop, []string{"\n"}) {
+		t.Fatalf("parsed %+v", req)
+	}
+
+	req, err = parseCompletionsRequest([]byte(`{"model":"m","prompt":"hi","stop":["a","b"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Stream || req.IncludeUsage || req.MaxTokens != nil || !slices.Equal(req.Stop, []string{"a", "b"}) {
+		t.Fatalf("parsed %+v", req)
+	}
+}
+
+// include_usage 时流的最后一块是choices为空、带usage的块，否则不带用量
+func TestStreamEndIncludeUsage(t *testing.T) {
+	resp := &CanonicalResponse{ID: "x", FinishReason: "length", Usage: Usage{PromptTokens: 1, CompletionTokens: 2, TotalTokens: 3}}
+	for _, encoder := range []responseEncoder{chatCompletionsEncoder{}, completionsEncoder{}} {
+		for _, include := range []bool{false, true} {
+			events := encoder.StreamEnd(&CanonicalRequest{IncludeUsage: include}, resp)
+			var encoded []string
+			for _, ev := range events {
+				data, _ := json.Marshal(ev)
+				encoded = append(encoded, string(data))
+			}
+
+			if !strings.Contains(encoded[0], `"finish_reason":"length"`) || strings.Contains(encoded[0], `"usage"`) {
+				t.Errorf("%T include_usage=%v: finish chunk %s", encoder, include, encoded[0])
+			}
+			if !include {
+				if len(encoded) != 1 {
+					t.Errorf("%T: usage chunk sent without include_usage: %v", encoder, encoded)
+				}
+				continue
+			}
+			if len(encoded) != 2 || !strings.Contains(encoded[1], `"choices":[]`) ||
+				!strings.Contains(encoded[1], `"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}`) {
+				t.Errorf("%T: usage chunk %v", encoder, encoded)
+			}
+		}
+	}
+}
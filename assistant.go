@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 默认的AI助手ID池
+var aiAssistantIDs = []string{
+	"6", "27", "36", "37", "90", "95",
+	"119", "122", "509", "727", "959", "1788",
+}
+
+// 全局助手池，startServer 会按配置重新创建
+var assistantPool = NewAssistantPool(aiAssistantIDs, 3, time.Minute)
+
+// 近期错误率的平滑系数，越大越偏重最近的结果
+const assistantErrorRateAlpha = 0.2
+
+// AssistantPool 在多个assistantId之间轮询，可被多个goroutine并发使用。
+// 连续失败达到阈值的ID会在冷却时间内被跳过
+type AssistantPool struct {
+	mu               sync.Mutex
+	ids              []string
+	next             int
+	stats            map[string]*assistantStats
+	failureThreshold int
+	cooldown         time.Duration
+}
+
+// 单个assistantId的健康统计
+type assistantStats struct {
+	requests            int64
+	errors              int64
+	errorRate           float64 // 指数加权的近期错误率
+	consecutiveFailures int
+	skipUntil           time.Time
+	lastError           string
+}
+
+// AssistantStatus 管理接口返回的单个assistantId状态
+type AssistantStatus struct {
+	ID                  string     `json:"id"`
+	Healthy             bool       `json:"healthy"`
+	Requests            int64      `json:"requests"`
+	Errors              int64      `json:"errors"`
+	ErrorRate           float64    `json:"error_rate"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	SkippedUntil        *time.Time `json:"skipped_until,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+func NewAssistantPool(ids []string, failureThreshold int, cooldown time.Duration) *AssistantPool {
+	stats := make(map[string]*assistantStats, len(ids))
+	for _, id := range ids {
+		stats[id] = &assistantStats{}
+	}
+	return &AssistantPool{
+		ids:              ids,
+		stats:            stats,
+		failureThreshold: max(failureThreshold, 1),
+		cooldown:         cooldown,
+	}
+}
+
+// Next 轮询返回下一个可用的assistantId；全部处于冷却时返回最早恢复的那个
+func (p *AssistantPool) Next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for range p.ids {
+		id := p.ids[p.next]
+		p.next = (p.next + 1) % len(p.ids)
+		if now.After(p.stats[id].skipUntil) {
+			return id
+		}
+	}
+
+	best := p.ids[0]
+	for _, id := range p.ids[1:] {
+		if p.stats[id].skipUntil.Before(p.stats[best].skipUntil) {
+			best = id
+		}
+	}
+	return best
+}
+
+// Report 记录一次请求结果，err为nil表示成功；ctx只用于日志关联请求ID
+func (p *AssistantPool) Report(ctx context.Context, id string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.stats[id]
+	if !ok {
+		return
+	}
+	s.requests++
+	if err == nil {
+		s.errorRate *= 1 - assistantErrorRateAlpha
+		s.consecutiveFailures = 0
+		return
+	}
+
+	s.errors++
+	s.errorRate = s.errorRate*(1-assistantErrorRateAlpha) + assistantErrorRateAlpha
+	s.consecutiveFailures++
+	s.lastError = err.Error()
+	if s.consecutiveFailures >= p.failureThreshold {
+		s.skipUntil = time.Now().Add(p.cooldown)
+		slog.WarnContext(ctx, "assistantId failing, skipping", "assistant_id", id, "consecutive_failures", s.consecutiveFailures, "cooldown", p.cooldown)
+	}
+}
+
+// Snapshot 返回所有assistantId的当前状态
+func (p *AssistantPool) Snapshot() []AssistantStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]AssistantStatus, 0, len(p.ids))
+	for _, id := range p.ids {
+		s := p.stats[id]
+		status := AssistantStatus{
+			ID:                  id,
+			Healthy:             !now.Before(s.skipUntil),
+			Requests:            s.requests,
+			Errors:              s.errors,
+			ErrorRate:           s.errorRate,
+			ConsecutiveFailures: s.consecutiveFailures,
+			LastError:           s.lastError,
+		}
+		if !status.Healthy {
+			skipUntil := s.skipUntil
+			status.SkippedUntil = &skipUntil
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// 判断错误是否应计入assistantId的健康统计；连接失败和token失效与具体助手无关
+func isAssistantFailure(err error) bool {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return !isAuthFailure(statusErr.StatusCode)
+	}
+	var streamErr *upstreamStreamError
+	return errors.As(err, &streamErr) || errors.Is(err, errEmptyAnswer)
+}
+
+// 管理接口：查看assistantId轮询状态
+func handleAdminAssistants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"object": "list",
+		"data":   assistantPool.Snapshot(),
+	})
+}
+
+// 管理接口鉴权：配置了 admin_token 时要求 Bearer 令牌匹配，否则只允许本机访问。
+// 同机部署的反向代理转发的请求也来自本机，此时应设置 admin_token
+func adminMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken != "" {
+			got := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(got, []byte("Bearer "+config.AdminToken)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopbackRequest(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// 判断请求是否来自本机
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestUpstream = &upstreamStatusError{StatusCode: http.StatusInternalServerError}
+
+// 连续失败达到阈值的ID在冷却期内被跳过，冷却结束后重新参与轮询
+func TestAssistantPoolSkipsDuringCooldown(t *testing.T) {
+	p := NewAssistantPool([]string{"a", "b", "c"}, 2, 50*time.Millisecond)
+
+	p.Report(context.Background(), "b", errTestUpstream)
+	if got := nextN(p, 3); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("one failure below threshold: got %v", got)
+	}
+
+	p.Report(context.Background(), "b", errTestUpstream)
+	for range 3 {
+		for _, id := range nextN(p, 4) {
+			if id == "b" {
+				t.Fatal("b returned during cooldown")
+			}
+		}
+	}
+	if status := findStatus(p.Snapshot(), "b"); status.Healthy || status.SkippedUntil == nil {
+		t.Fatalf("snapshot during cooldown: %+v", status)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := nextN(p, 3); !slices.Contains(got, "b") {
+		t.Fatalf("b not returned after cooldown: %v", got)
+	}
+}
+
+// 成功会清零连续失败计数
+func TestAssistantPoolSuccessResetsFailures(t *testing.T) {
+	p := NewAssistantPool([]string{"a", "b"}, 2, time.Minute)
+	p.Report(context.Background(), "a", errTestUpstream)
+	p.Report(context.Background(), "a", nil)
+	p.Report(context.Background(), "a", errTestUpstream)
+	if status := findStatus(p.Snapshot(), "a"); !status.Healthy || status.ConsecutiveFailures != 1 {
+		t.Fatalf("status after fail/ok/fail: %+v", status)
+	}
+}
+
+// 全部处于冷却时返回最早恢复的ID，而不是让请求失败
+func TestAssistantPoolAllCoolingDown(t *testing.T) {
+	p := NewAssistantPool([]string{"a", "b"}, 1, time.Minute)
+	p.Report(context.Background(), "b", errTestUpstream)
+	time.Sleep(time.Millisecond)
+	p.Report(context.Background(), "a", errTestUpstream)
+	if got := p.Next(); got != "b" {
+		t.Fatalf("Next = %q, want b (earliest to recover)", got)
+	}
+}
+
+// 并发轮询和上报，配合 -race 检查数据竞争；没有ID进入冷却时每个ID被选中的次数相同
+func TestAssistantPoolConcurrent(t *testing.T) {
+	ids := []string{"a", "b", "c", "d"}
+	p := NewAssistantPool(ids, 1000, time.Minute)
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				id := p.Next()
+				var err error
+				if (g+i)%3 == 0 {
+					err = errTestUpstream
+				}
+				p.Report(context.Background(), id, err)
+				mu.Lock()
+				counts[id]++
+				mu.Unlock()
+			}
+			p.Snapshot()
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if counts[id] != 200 {
+			t.Errorf("%s picked %d times, want 200", id, counts[id])
+		}
+	}
+}
+
+func TestIsAssistantFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&upstreamStatusError{StatusCode: 500}, true},
+		{&upstreamStatusError{StatusCode: 429}, true},
+		{&upstreamStatusError{StatusCode: 401}, false},
+		{&upstreamStatusError{StatusCode: 403}, false},
+		{&upstreamStreamError{Message: "x"}, true},
+		{errEmptyAnswer, true},
+		{errUpstreamRequest, false},
+		{errors.New("auth failed: bad password"), false},
+	} {
+		if got := isAssistantFailure(tc.err); got != tc.want {
+			t.Errorf("isAssistantFailure(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	saved := config.AdminToken
+	t.Cleanup(func() { config.AdminToken = saved })
+	handler := adminMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tc := range []struct {
+		token, auth, remote string
+		want                int
+	}{
+		{"", "", "127.0.0.1:1234", http.StatusOK},
+		{"", "", "[::1]:1234", http.StatusOK},
+		{"", "", "203.0.113.5:1234", http.StatusForbidden},
+		{"s3cret", "Bearer s3cret", "203.0.113.5:1234", http.StatusOK},
+		{"s3cret", "Bearer s3cre", "127.0.0.1:1234", http.StatusUnauthorized},
+		{"s3cret", "Bearer s3cretx", "127.0.0.1:1234", http.StatusUnauthorized},
+		{"s3cret", "", "127.0.0.1:1234", http.StatusUnauthorized},
+	} {
+		config.AdminToken = tc.token
+		req := httptest.NewRequest(http.MethodGet, "/admin/assistants", nil)
+		req.RemoteAddr = tc.remote
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("admin_token=%q auth=%q remote=%s: status %d, want %d", tc.token, tc.auth, tc.remote, rec.Code, tc.want)
+		}
+	}
+}
+
+func nextN(p *AssistantPool, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = p.Next()
+	}
+	return ids
+}
+
+func findStatus(statuses []AssistantStatus, id string) AssistantStatus {
+	for _, s := range statuses {
+		if s.ID == id {
+			return s
+		}
+	}
+	return AssistantStatus{}
+}
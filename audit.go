@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditRecord 审计日志中的一行，每个请求一条
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	API           string    `json:"api"`
+	KeyID         string    `json:"key_id"`
+	KeyName       string    `json:"key_name"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Model         string    `json:"model,omitempty"`
+	ResolvedModel string    `json:"resolved_model,omitempty"` // 实际回答的上游模型
+	Stream        bool      `json:"stream"`
+	ResumedFrom   string    `json:"resumed_from,omitempty"` // 续传重连携带的 Last-Event-ID
+	Status        int       `json:"status"`
+	LatencyMS     int64     `json:"latency_ms"`
+	FinishReason  string    `json:"finish_reason,omitempty"`
+	Usage         *Usage    `json:"usage,omitempty"`
+	Prompt        string    `json:"prompt,omitempty"`
+	PromptHMAC    string    `json:"prompt_hmac,omitempty"`
+	Answer        string    `json:"answer,omitempty"`
+	AnswerHMAC    string    `json:"answer_hmac,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// AuditLog 以JSONL写入的审计日志，文件超过 max_size 后轮转为 .1、.2 ...，最多保留 max_files 个旧文件
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	capture  string // "full"、"hash" 或 "omit"
+	hashKey  []byte // capture 为 hash 时 HMAC-SHA256 的密钥
+	file     *os.File
+	size     int64
+}
+
+// 全局审计日志，startServer 按配置初始化；为nil时不记录
+var auditLog *AuditLog
+
+// NewAuditLog 打开（或创建）审计日志文件，已有内容之后继续追加
+func NewAuditLog(cfg AuditConfig, stateDir string) (*AuditLog, error) {
+	switch cfg.Capture {
+	case "full", "hash", "omit":
+	default:
+		return nil, fmt.Errorf("audit.capture 应为 full、hash 或 omit: %q", cfg.Capture)
+	}
+	path := cfg.Path
+	if path == "" {
+		path = filepath.Join(stateDir, "audit.jsonl")
+	}
+
+	a := &AuditLog{
+		path:     path,
+		maxSize:  int64(cfg.MaxSizeMB) << 20,
+		maxFiles: cfg.MaxFiles,
+		capture:  cfg.Capture,
+	}
+	// 不加密钥的哈希可以被逐个猜测短prompt还原，因此 hash 模式必须配置密钥
+	if cfg.Capture == "hash" {
+		keyEnv := cfg.HashKeyEnv
+		if keyEnv == "" {
+			keyEnv = "ULLM_AUDIT_KEY"
+		}
+		encoded := os.Getenv(keyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("audit.capture hash requires the %s environment variable", keyEnv)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s must be a base64-encoded 32-byte key (generate one with `openssl rand -base64 32`)", keyEnv)
+		}
+		a.hashKey = key
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := a.openLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) openLocked() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// Write 追加一条记录，写入前按 capture 处理prompt和回答
+func (a *AuditLog) Write(rec *auditRecord) {
+	switch a.capture {
+	case "hash":
+		rec.PromptHMAC, rec.Prompt = a.hmacHex(rec.Prompt), ""
+		rec.AnswerHMAC, rec.Answer = a.hmacHex(rec.Answer), ""
+	case "omit":
+		rec.Prompt, rec.Answer = "", ""
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Warn("写入审计日志失败", "request_id", rec.RequestID, "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotateLocked(); err != nil {
+			slog.Warn("审计日志轮转失败", "path", a.path, "err", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		slog.Warn("写入审计日志失败", "request_id", rec.RequestID, "err", err)
+	}
+}
+
+// 当前文件改名为 .1，已有的旧文件依次后移，超出 max_files 的被删除
+func (a *AuditLog) rotateLocked() error {
+	if err := a.file.Close(); err != nil {
+		slog.Warn("关闭审计日志失败", "path", a.path, "err", err)
+	}
+	a.file = nil
+
+	if a.maxFiles <= 0 {
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+		return a.openLocked()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.openLocked()
+}
+
+// Close 关闭文件，之后的记录被丢弃
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// 相同内容得到相同结果，便于在日志中关联，但没有密钥无法验证猜测的原文
+func (a *AuditLog) hmacHex(s string) string {
+	if s == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, a.hashKey)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditEntry 收集一个请求的审计信息，请求结束时由 Finish 写入
+type auditEntry struct {
+	start time.Time
+	rec   auditRecord
+	req   *CanonicalRequest
+	resp  *CanonicalResponse
+	err   error
+}
+
+func newAuditEntry(requestID, api string, key *APIKey, r *http.Request) *auditEntry {
+	return &auditEntry{
+		start: time.Now(),
+		rec: auditRecord{
+			RequestID:  requestID,
+			API:        api,
+			KeyID:      key.ID,
+			KeyName:    key.Name,
+			RemoteAddr: r.RemoteAddr,
+		},
+	}
+}
+
+// Finish 以最终的HTTP状态写入审计记录；未启用审计日志时什么都不做
+func (e *auditEntry) Finish(status int) {
+	if auditLog == nil {
+		return
+	}
+	rec := e.rec
+	rec.Time = e.start.UTC()
+	rec.Status = status
+	rec.LatencyMS = time.Since(e.start).Milliseconds()
+	if req := e.req; req != nil {
+		rec.Model, rec.Stream, rec.Prompt = req.Model, req.Stream, req.Prompt
+	}
+	if resp := e.resp; resp != nil {
+		usage := resp.Usage
+		rec.ResolvedModel, rec.FinishReason, rec.Answer, rec.Usage = resp.ResolvedModel, resp.FinishReason, resp.Text, &usage
+	}
+	if e.err != nil {
+		rec.Error = redactString(e.err.Error())
+	}
+	auditLog.Write(&rec)
+}
+
+// auditAuthRejection 记录被 apiKeyMiddleware 拒绝的请求，key未知时key_id为空
+func auditAuthRejection(r *http.Request, key *APIKey, status int, reason string) {
+	if auditLog == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:       time.Now().UTC(),
+		RequestID:  requestIDFromContext(r.Context()),
+		API:        r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Status:     status,
+		Error:      reason,
+	}
+	if key != nil {
+		rec.KeyID, rec.KeyName = key.ID, key.Name
+	}
+	auditLog.Write(&rec)
+}
+
+// wrapStream 在流式生成结束时写入审计记录。续传开启时生成可能在客户端断开后继续，
+// 因此不在请求处理函数返回时记录
+func (e *auditEntry) wrapStream(produce func(ctx context.Context, sink streamSink) *streamFailure) func(ctx context.Context, sink streamSink) *streamFailure {
+	return func(ctx context.Context, sink streamSink) *streamFailure {
+		failure := produce(ctx, sink)
+		status := http.StatusOK
+		switch {
+		case failure != nil:
+			status = failure.status
+		case e.resp == nil:
+			status = 499 // 客户端在回答前断开
+		}
+		e.Finish(status)
+		return failure
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuditKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // 32字节
+
+// useAuditLog 在测试期间启用写入临时目录的审计日志，返回读取全部记录的函数
+func useAuditLog(t *testing.T, capture string) func() []auditRecord {
+	t.Helper()
+	t.Setenv("ULLM_AUDIT_KEY", testAuditKey)
+	dir := t.TempDir()
+	audit, err := NewAuditLog(AuditConfig{Capture: capture}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := auditLog
+	auditLog = audit
+	t.Cleanup(func() {
+		auditLog = saved
+		audit.Close()
+	})
+
+	return func() []auditRecord {
+		f, err := os.Open(filepath.Join(dir, "audit.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var records []auditRecord
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		return records
+	}
+}
+
+func TestAuditHashRequiresKey(t *testing.T) {
+	t.Setenv("ULLM_AUDIT_KEY", "")
+	if _, err := NewAuditLog(AuditConfig{Capture: "hash"}, t.TempDir()); err == nil {
+		t.Fatal("hash capture accepted without a key")
+	}
+	t.Setenv("ULLM_AUDIT_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := NewAuditLog(AuditConfig{Capture: "hash"}, t.TempDir()); err == nil {
+		t.Fatal("hash capture accepted a short key")
+	}
+	t.Setenv("OTHER_AUDIT_KEY", testAuditKey)
+	a, err := NewAuditLog(AuditConfig{Capture: "hash", HashKeyEnv: "OTHER_AUDIT_KEY"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	// full 和 omit 不需要密钥
+	a, err = NewAuditLog(AuditConfig{Capture: "omit"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+}
+
+// hash 模式记录的是带密钥的HMAC，不是可以直接比对猜测原文的SHA-256
+func TestAuditHashIsKeyed(t *testing.T) {
+	records := useAuditLog(t, "hash")
+	auditLog.Write(&auditRecord{RequestID: "a", Prompt: "yes", Answer: "no"})
+	auditLog.Write(&auditRecord{RequestID: "b", Prompt: "yes"})
+
+	got := records()
+	if len(got) != 2 {
+		t.Fatalf("%d records", len(got))
+	}
+	plain := sha256.Sum256([]byte("yes"))
+	if rec := got[0]; rec.Prompt != "" || rec.Answer != "" || rec.PromptHMAC == "" || rec.AnswerHMAC == "" ||
+		rec.PromptHMAC == hex.EncodeToString(plain[:]) {
+		t.Fatalf("record = %+v", rec)
+	}
+	if got[0].PromptHMAC != got[1].PromptHMAC {
+		t.Fatal("same prompt should hash the same under one key")
+	}
+}
+
+func TestAuditAuthRejectionAndResume(t *testing.T) {
+	records := useAuditLog(t, "omit")
+	useStreamConfig(t, StreamConfig{ResumeWindow: Duration(time.Minute)})
+
+	// 没有提供key的401
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader("{}"))
+	rec := httptest.NewRecorder()
+	apiKeyMiddleware(handleChatCompletions)(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	// 找不到流的续传重连
+	req = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer sk-test")
+	req.Header.Set("Last-Event-ID", "strm_missing:3")
+	rec = httptest.NewRecorder()
+	apiKeyMiddleware(handleChatCompletions)(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	got := records()
+	if len(got) != 2 {
+		t.Fatalf("records = %+v", got)
+	}
+	if r := got[0]; r.Status != http.StatusUnauthorized || r.API != "/v1/chat/completions" || r.KeyID != "" || r.Error != "missing API key" {
+		t.Fatalf("auth rejection record = %+v", r)
+	}
+	if r := got[1]; r.Status != http.StatusNotFound || !r.Stream || r.ResumedFrom != "strm_missing:3" || r.KeyID == "" {
+		t.Fatalf("resume record = %+v", r)
+	}
+}
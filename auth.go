@@ -1,37 +1,17 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 )
 
-func getToken() (string, error) {
-	// 检查缓存文件是否存在
-	if _, err := os.Stat("cache.json"); err == nil {
-		// 读取缓存文件
-		data, err := os.ReadFile("cache.json")
-		if err != nil {
-			return "", err
-		}
-
-		var cache TokenCache
-		if err := json.Unmarshal(data, &cache); err != nil {
-			return "", err
-		}
-
-		// 检查token是否过期
-		if time.Now().Before(cache.ExpireTime) {
-			return cache.Token, nil
-		}
-	}
-
-	// 如果缓存不存在或已过期，重新登录获取token
+// loginUpstream 使用内置账号登录，返回上游token
+func loginUpstream() (string, error) {
 	loginData := url.Values{}
 	loginData.Set("loginName", "hfdhdfhfd")
 	loginData.Set("password", "Aa123456")
@@ -42,10 +22,11 @@ func getToken() (string, error) {
 		return "", fmt.Errorf("创建 cookie jar 失败: %v", err)
 	}
 
-	// 创建一个允许重定向的客户端，并设置 cookie jar
+	// 创建一个允许重定向的客户端，并设置 cookie jar；复用共享的上游连接池
 	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Jar:     jar,
+		Transport: upstreamClient.Transport,
+		Timeout:   10 * time.Second,
+		Jar:       jar,
 	}
 
 	// 创建请求
@@ -93,20 +74,48 @@ func getToken() (string, error) {
 			cookies)
 	}
 
-	// 缓存token，设置1小时过期
-	cache := TokenCache{
-		Token:      token,
-		ExpireTime: time.Now().Add(time.Hour),
+	return token, nil
+}
+
+// 判断上游是否因token失效拒绝了请求
+func isAuthFailure(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// doWithToken 携带token发送上游请求；上游返回401/403时作废该token，
+// 重新登录一次并重放请求。newRequest 需为每次调用构建新的请求
+func doWithToken(client *http.Client, newRequest func(token string) (*http.Request, error)) (*http.Response, error) {
+	token, err := tokenManager.Token()
+	if err != nil {
+		return nil, fmt.Errorf("auth failed: %v", err)
 	}
 
-	cacheData, err := json.Marshal(cache)
+	req, err := newRequest(token)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUpstreamRequest, err)
+	}
+	if !isAuthFailure(resp.StatusCode) {
+		return resp, nil
+	}
+	resp.Body.Close()
 
-	if err := os.WriteFile("cache.json", cacheData, 0644); err != nil {
-		return "", err
+	slog.WarnContext(req.Context(), "upstream rejected token, logging in again", "status", resp.StatusCode)
+	token, err = tokenManager.Refresh(token)
+	if err != nil {
+		return nil, fmt.Errorf("auth failed: %v", err)
 	}
 
-	return token, nil
-}
\ No newline at end of file
+	req, err = newRequest(token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUpstreamRequest, err)
+	}
+	return resp, nil
+}
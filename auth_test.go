@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 每次登录返回 tok-1、tok-2……，可让第n次之后的登录失败
+func useCountingLogin(t *testing.T, failAfter int) *atomic.Int32 {
+	t.Helper()
+	var logins atomic.Int32
+	tokenManager = NewTokenManager(&memoryTokenStore{}, func() (string, error) {
+		n := logins.Add(1)
+		if failAfter > 0 && int(n) > failAfter {
+			return "", errors.New("login rejected")
+		}
+		return fmt.Sprintf("tok-%d", n), nil
+	})
+	return &logins
+}
+
+// 上游拒绝token时重新登录并只重放一次
+func TestDoWithTokenRelogin(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		rejected   func(token string) int // 对该token返回的状态码，0表示接受
+		failAfter  int
+		wantTokens []string
+		wantLogins int32
+		wantErr    string
+		wantStatus int
+	}{
+		{
+			name:       "401 then success",
+			rejected:   func(token string) int { return map[string]int{"tok-1": 401}[token] },
+			wantTokens: []string{"tok-1", "tok-2"},
+			wantLogins: 2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "403 then success",
+			rejected:   func(token string) int { return map[string]int{"tok-1": 403}[token] },
+			wantTokens: []string{"tok-1", "tok-2"},
+			wantLogins: 2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "still rejected after relogin",
+			rejected:   func(string) int { return 401 },
+			wantTokens: []string{"tok-1", "tok-2"},
+			wantLogins: 2,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "relogin fails",
+			rejected:   func(string) int { return 401 },
+			failAfter:  1,
+			wantTokens: []string{"tok-1"},
+			wantLogins: 2,
+			wantErr:    "auth failed",
+		},
+		{
+			name:       "other errors are not relogins",
+			rejected:   func(string) int { return 500 },
+			wantTokens: []string{"tok-1"},
+			wantLogins: 1,
+			wantStatus: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var tokens []string
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				token := r.Header.Get("Authorization")
+				mu.Lock()
+				tokens = append(tokens, token)
+				mu.Unlock()
+				if status := tc.rejected(token); status != 0 {
+					w.WriteHeader(status)
+					return
+				}
+				writeKBChatAnswer(w, "ok")
+			})
+			logins := useCountingLogin(t, tc.failAfter)
+			refreshesBefore := tokenRefreshes.Value()
+
+			resp, err := doWithToken(upstreamClient, func(token string) (*http.Request, error) {
+				req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, chatAPIURL, strings.NewReader("{}"))
+				if err == nil {
+					req.Header.Set("Authorization", token)
+				}
+				return req, err
+			})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tc.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.wantStatus {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(tokens, tc.wantTokens) {
+				t.Fatalf("upstream saw tokens %v, want %v", tokens, tc.wantTokens)
+			}
+			if logins.Load() != tc.wantLogins {
+				t.Fatalf("logins = %d, want %d", logins.Load(), tc.wantLogins)
+			}
+			// 首次登录和重新登录都计入 token_refreshes
+			if got := tokenRefreshes.Value() - refreshesBefore; got != int64(tc.wantLogins) {
+				t.Fatalf("token_refreshes increased by %d, want %d", got, tc.wantLogins)
+			}
+		})
+	}
+}
+
+// 重新登录后仍被拒绝时，客户端看到的是502而不是上游的401
+func TestProcessChatRequestAuthFailureIs502(t *testing.T) {
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	useCountingLogin(t, 0)
+
+	_, err := processChatRequest(context.Background(), ChatProcessParams{Model: "qwen", Prompt: "hi"})
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("err = %v", err)
+	}
+	if isRetryableUpstreamError(err) || isAssistantFailure(err) || upstreamErrorStatus(err) != http.StatusBadGateway {
+		t.Fatalf("auth failure treated as retryable/assistant failure or not mapped to 502: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// 请求优先级，由key的 priority 标签决定；同一优先级内按key轮询
+var priorityClasses = []string{"high", "normal", "low"}
+
+const defaultPriority = "normal"
+
+var (
+	errQueueFull    = errors.New("too many requests waiting for an upstream slot")
+	errQueueTimeout = errors.New("timed out waiting for an upstream slot")
+)
+
+// 排队相关计数，通过 /debug/vars 暴露
+var (
+	upstreamQueueTimeouts = expvar.NewInt("upstream_queue_timeouts")
+	upstreamQueueRejected = expvar.NewInt("upstream_queue_rejected")
+)
+
+// 同一优先级下各key的等待队列，按key轮询出队
+type priorityQueue struct {
+	keys    []string // 有请求在等待的key，按轮询顺序
+	waiters map[string]*slotQueue[struct{}]
+	next    int
+}
+
+// UpstreamLimiter 限制同时进行的上游请求数。超出时请求排队：
+// 高优先级先出队，同一优先级内在key之间轮询，同一key内先进先出，避免单个key占满所有名额
+type UpstreamLimiter struct {
+	mu       sync.Mutex
+	max      int // 0表示不限制
+	maxQueue int // 0表示不限制
+	timeout  time.Duration
+	inFlight int
+	queued   int
+	classes  map[string]*priorityQueue
+}
+
+// 全局上游并发限制，startServer 按配置初始化
+var upstreamLimiter = NewUpstreamLimiter(ConcurrencyConfig{})
+
+func init() {
+	expvar.Publish("upstream_in_flight", expvar.Func(func() any { return upstreamLimiter.Stats().InFlight }))
+	expvar.Publish("upstream_queue_depth", expvar.Func(func() any { return upstreamLimiter.Stats().Queued }))
+}
+
+func NewUpstreamLimiter(cfg ConcurrencyConfig) *UpstreamLimiter {
+	l := &UpstreamLimiter{
+		max:      cfg.MaxInFlight,
+		maxQueue: cfg.MaxQueue,
+		timeout:  time.Duration(cfg.QueueTimeout),
+		classes:  make(map[string]*priorityQueue),
+	}
+	for _, class := range priorityClasses {
+		l.classes[class] = &priorityQueue{waiters: make(map[string]*slotQueue[struct{}])}
+	}
+	return l
+}
+
+// UpstreamLimiterStats 当前的并发和排队情况
+type UpstreamLimiterStats struct {
+	InFlight int            `json:"in_flight"`
+	Queued   int            `json:"queued"`
+	ByClass  map[string]int `json:"by_class"`
+}
+
+func (l *UpstreamLimiter) Stats() UpstreamLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := UpstreamLimiterStats{InFlight: l.inFlight, Queued: l.queued, ByClass: map[string]int{}}
+	for class, q := range l.classes {
+		for _, waiters := range q.waiters {
+			stats.ByClass[class] += waiters.Len()
+		}
+	}
+	return stats
+}
+
+// Acquire 等待一个上游请求名额，成功时返回的release必须在上游请求结束后调用。
+// 排队超过 queue_timeout、队列已满或ctx结束时返回错误
+func (l *UpstreamLimiter) Acquire(ctx context.Context, keyID, priority string) (func(), error) {
+	l.mu.Lock()
+	if l.max <= 0 || (l.inFlight < l.max && l.queued == 0) {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.releaseFunc(), nil
+	}
+	if l.maxQueue > 0 && l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		upstreamQueueRejected.Add(1)
+		return nil, errQueueFull
+	}
+
+	q, ok := l.classes[priority]
+	if !ok {
+		q = l.classes[defaultPriority]
+	}
+	w := q.enqueue(keyID)
+	l.queued++
+	l.mu.Unlock()
+
+	err := w.Wait(ctx, &l.mu, l.timeout, errQueueTimeout, func(granted bool) {
+		if granted {
+			l.inFlight--
+			l.dispatchLocked()
+			return
+		}
+		q.remove(keyID, w)
+		l.queued--
+	})
+	if err != nil {
+		if err == errQueueTimeout {
+			upstreamQueueTimeouts.Add(1)
+		}
+		return nil, err
+	}
+	return l.releaseFunc(), nil
+}
+
+func (l *UpstreamLimiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.inFlight--
+			l.dispatchLocked()
+		})
+	}
+}
+
+// 有空闲名额时按优先级和轮询顺序唤醒等待的请求
+func (l *UpstreamLimiter) dispatchLocked() {
+	for l.queued > 0 && l.inFlight < l.max {
+		for _, class := range priorityClasses {
+			if l.classes[class].grantNext() {
+				l.inFlight++
+				l.queued--
+				break
+			}
+		}
+	}
+}
+
+// enqueue 把key的一个请求排到该key的队尾
+func (q *priorityQueue) enqueue(keyID string) *slotWaiter[struct{}] {
+	waiters, ok := q.waiters[keyID]
+	if !ok {
+		waiters = &slotQueue[struct{}]{}
+		q.waiters[keyID] = waiters
+		q.keys = append(q.keys, keyID)
+	}
+	return waiters.Enqueue(struct{}{})
+}
+
+// grantNext 把名额交给轮询到的key最早的等待者，没有等待者时返回false
+func (q *priorityQueue) grantNext() bool {
+	if len(q.keys) == 0 {
+		return false
+	}
+	q.next %= len(q.keys)
+	keyID := q.keys[q.next]
+	waiters := q.waiters[keyID]
+	waiters.GrantNext()
+	if waiters.Len() == 0 {
+		// 该key已没有等待的请求，移出轮询；next 自然指向下一个key
+		delete(q.waiters, keyID)
+		q.keys = append(q.keys[:q.next], q.keys[q.next+1:]...)
+	} else {
+		q.next++
+	}
+	return true
+}
+
+// remove 移除超时或取消的等待者
+func (q *priorityQueue) remove(keyID string, w *slotWaiter[struct{}]) {
+	waiters := q.waiters[keyID]
+	waiters.Remove(w)
+	if waiters.Len() > 0 {
+		return
+	}
+
+	delete(q.waiters, keyID)
+	for i, other := range q.keys {
+		if other == keyID {
+			q.keys = append(q.keys[:i], q.keys[i+1:]...)
+			if i < q.next {
+				q.next--
+			}
+			break
+		}
+	}
+}
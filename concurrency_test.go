@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 依次排入等待者，确保入队顺序确定
+func enqueueWaiter(t *testing.T, l *UpstreamLimiter, ctx context.Context, keyID, priority string, done func(func(), error)) {
+	t.Helper()
+	queued := l.Stats().Queued
+	go func() { done(l.Acquire(ctx, keyID, priority)) }()
+	waitFor(t, func() bool { return l.Stats().Queued == queued+1 })
+}
+
+// 同一优先级内在key之间轮询，高优先级先出队
+func TestUpstreamLimiterFairness(t *testing.T) {
+	l := NewUpstreamLimiter(ConcurrencyConfig{MaxInFlight: 1})
+	release, err := l.Acquire(context.Background(), "holder", defaultPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, w := range []struct{ key, priority, name string }{
+		{"a", "normal", "a1"}, {"a", "normal", "a2"}, {"a", "normal", "a3"},
+		{"b", "normal", "b1"}, {"c", "low", "c1"}, {"d", "high", "d1"},
+	} {
+		wg.Add(1)
+		enqueueWaiter(t, l, context.Background(), w.key, w.priority, func(release func(), err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Errorf("%s: %v", w.name, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, w.name)
+			mu.Unlock()
+			release()
+		})
+	}
+
+	release()
+	wg.Wait()
+	if want := []string{"d1", "a1", "b1", "a2", "a3", "c1"}; !slices.Equal(order, want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	if stats := l.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestUpstreamLimiterCancelAndTimeout(t *testing.T) {
+	l := NewUpstreamLimiter(ConcurrencyConfig{MaxInFlight: 1, MaxQueue: 2, QueueTimeout: Duration(50 * time.Millisecond)})
+	release, err := l.Acquire(context.Background(), "holder", defaultPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	enqueueWaiter(t, l, ctx, "a", defaultPriority, func(_ func(), err error) { cancelled <- err })
+	timedOut := make(chan error, 1)
+	enqueueWaiter(t, l, context.Background(), "b", defaultPriority, func(_ func(), err error) { timedOut <- err })
+
+	if _, err := l.Acquire(context.Background(), "c", defaultPriority); !errors.Is(err, errQueueFull) {
+		t.Fatalf("third waiter: err = %v, want errQueueFull", err)
+	}
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled waiter: err = %v", err)
+	}
+	if err := <-timedOut; !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("timed out waiter: err = %v", err)
+	}
+	if stats := l.Stats(); stats.InFlight != 1 || stats.Queued != 0 {
+		t.Fatalf("stats after giving up = %+v", stats)
+	}
+
+	release()
+	release() // 重复调用不会多还名额
+	if stats := l.Stats(); stats.InFlight != 0 {
+		t.Fatalf("stats after release = %+v", stats)
+	}
+	next, err := l.Acquire(context.Background(), "d", defaultPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next()
+}
+
+// 等待者放弃的同时刚好被分配到名额：名额交给下一个等待者，不会泄漏
+func TestUpstreamLimiterGrantedWhileGivingUp(t *testing.T) {
+	l := NewUpstreamLimiter(ConcurrencyConfig{MaxInFlight: 1})
+	if _, err := l.Acquire(context.Background(), "holder", defaultPriority); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	enqueueWaiter(t, l, ctx, "a", defaultPriority, func(_ func(), err error) { first <- err })
+	second := make(chan func(), 1)
+	enqueueWaiter(t, l, context.Background(), "b", defaultPriority, func(release func(), err error) {
+		if err != nil {
+			t.Errorf("second waiter: %v", err)
+		}
+		second <- release
+	})
+
+	// 持锁期间取消第一个等待者，使其停在加锁处；随后在同一把锁内释放名额并分配给它
+	l.mu.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	l.inFlight--
+	l.dispatchLocked()
+	l.mu.Unlock()
+
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first waiter: err = %v, want context.Canceled", err)
+	}
+	var release func()
+	select {
+	case release = <-second:
+	case <-time.After(time.Second):
+		t.Fatal("slot was not handed over to the second waiter")
+	}
+	if release == nil {
+		t.Fatal("second waiter got no slot")
+	}
+	if stats := l.Stats(); stats.InFlight != 1 || stats.Queued != 0 {
+		t.Fatalf("stats = %+v, want the handed-over slot in flight", stats)
+	}
+	release()
+	if stats := l.Stats(); stats.InFlight != 0 {
+		t.Fatalf("stats after release = %+v", stats)
+	}
+}
+
+// 大量并发的获取、取消和超时结束后，名额和队列计数都归零
+func TestUpstreamLimiterStress(t *testing.T) {
+	l := NewUpstreamLimiter(ConcurrencyConfig{MaxInFlight: 3, QueueTimeout: Duration(5 * time.Millisecond)})
+
+	var wg sync.WaitGroup
+	for i := range 300 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%4)*time.Millisecond)
+			defer cancel()
+			release, err := l.Acquire(ctx, string(rune('a'+i%5)), priorityClasses[i%len(priorityClasses)])
+			if err != nil {
+				return
+			}
+			if stats := l.Stats(); stats.InFlight > 3 {
+				t.Errorf("in flight %d exceeds max", stats.InFlight)
+			}
+			time.Sleep(time.Millisecond)
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if stats := l.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("stats = %+v, want all slots returned", stats)
+	}
+}
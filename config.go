@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Config 服务配置，未在配置文件中出现的字段保持默认值
+type Config struct {
+	StateDir        string            `json:"state_dir"`        // 运行时状态文件目录，默认 $XDG_STATE_HOME/ullm
+	AdminToken      string            `json:"admin_token"`      // 管理接口的Bearer令牌，为空时仅允许本机访问
+	ShutdownTimeout Duration          `json:"shutdown_timeout"` // 退出时等待进行中请求完成的最长时间
+	Upstream        UpstreamConfig    `json:"upstream"`
+	Retry           RetryConfig       `json:"retry"`
+	Stream          StreamConfig      `json:"stream"`
+	TokenStore      TokenStoreConfig  `json:"token_store"`
+	Assistants      AssistantConfig   `json:"assistants"`
+	Auth            AuthConfig        `json:"auth"`
+	RateLimits      RateLimitConfig   `json:"rate_limits"`
+	Quotas          QuotaConfig       `json:"quotas"`
+	Concurrency     ConcurrencyConfig `json:"concurrency"`
+	Log             LogConfig         `json:"log"`
+	Audit           AuditConfig       `json:"audit"`
+	Hooks           []HookConfig      `json:"hooks"` // 按顺序执行的请求/响应钩子
+}
+
+// UpstreamConfig 上游kbChat请求配置
+type UpstreamConfig struct {
+	Timeout               Duration `json:"timeout"`                 // 一个请求调用上游（含重试、备用模型和读取完整流式响应）的总时长上限，0表示不限制
+	DialTimeout           Duration `json:"dial_timeout"`            // 建立TCP连接超时
+	KeepAlive             Duration `json:"keep_alive"`              // TCP keep-alive 间隔
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`   // TLS握手超时
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"` // 发出请求后等待响应头的超时
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`       // 空闲连接保留时间
+	MaxIdleConns          int      `json:"max_idle_conns"`          // 连接池最大空闲连接数
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"` // 每个上游主机的最大空闲连接数
+	ProxyURL              string   `json:"proxy_url"`               // HTTP代理，为空时使用 HTTP_PROXY/HTTPS_PROXY 环境变量
+	CAFile                string   `json:"ca_file"`                 // 额外信任的CA证书（PEM）
+}
+
+// RetryConfig 上游请求重试配置
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // 每个模型的最大尝试次数（含首次请求）
+	BaseDelay   Duration `json:"base_delay"`   // 第一次重试前的等待时间，之后指数增长
+	MaxDelay    Duration `json:"max_delay"`    // 单次等待时间上限
+}
+
+// StreamConfig 流式响应配置
+type StreamConfig struct {
+	HeartbeatInterval Duration `json:"heartbeat_interval"` // 无输出多久后发送一次 ": ping" 心跳，0表示关闭
+	ResumeWindow      Duration `json:"resume_window"`      // 流结束后保留事件以供重连的时间，0表示关闭续传
+	ResumeGrace       Duration `json:"resume_grace"`       // 客户端全部断开后继续生成、等待重连的时间
+	MaxPerKey         int      `json:"max_per_key"`        // 每个key同时打开的流式连接上限，0表示不限制
+	Overflow          string   `json:"overflow"`           // 超过上限时 "reject"（默认，返回429）或 "queue"（排队等待）
+	QueueTimeout      Duration `json:"queue_timeout"`      // overflow 为 queue 时排队的最长时间
+}
+
+// TokenStoreConfig 上游token缓存的存储方式
+type TokenStoreConfig struct {
+	Type   string `json:"type"`    // "file"（默认）、"memory" 或 "encrypted_file"
+	Path   string `json:"path"`    // 缓存文件路径，默认为状态目录下的 token.json
+	KeyEnv string `json:"key_env"` // encrypted_file 使用的密钥（base64编码的32字节）所在环境变量，默认 ULLM_TOKEN_KEY
+}
+
+// AssistantConfig assistantId轮询与健康检查配置
+type AssistantConfig struct {
+	IDs              []string `json:"ids"`               // 参与轮询的assistantId
+	FailureThreshold int      `json:"failure_threshold"` // 连续失败多少次后暂时跳过
+	Cooldown         Duration `json:"cooldown"`          // 跳过的时长
+}
+
+// AuthConfig 客户端API key校验配置
+type AuthConfig struct {
+	KeysFile       string `json:"keys_file"`       // 密钥文件，默认为状态目录下的 keys.json
+	AllowAnonymous bool   `json:"allow_anonymous"` // 不校验key，接受任意非空key（旧行为）
+}
+
+// RateLimitConfig 客户端key的速率限制
+type RateLimitConfig struct {
+	Default RateLimit            `json:"default"` // 未单独设置限额的key使用的限额
+	Models  map[string]RateLimit `json:"models"`  // 每个key请求某个模型时额外适用的限额
+}
+
+// QuotaConfig 每日/每月token额度配置，额度本身在每个key上设置
+type QuotaConfig struct {
+	Timezone string `json:"timezone"` // 计算日、月边界的时区，如 "Asia/Shanghai"，默认本地时区
+}
+
+// ConcurrencyConfig 同时进行的上游请求数限制，超出的请求按优先级和key公平排队
+type ConcurrencyConfig struct {
+	MaxInFlight  int      `json:"max_in_flight"` // 同时进行的上游请求数上限，0表示不限制
+	MaxQueue     int      `json:"max_queue"`     // 最多排队的请求数，0表示不限制
+	QueueTimeout Duration `json:"queue_timeout"` // 排队的最长时间，超过后返回503
+}
+
+// LogConfig 日志格式和级别
+type LogConfig struct {
+	Format string `json:"format"` // "text"（默认）或 "json"
+	Level  string `json:"level"`  // debug、info（默认）、warn 或 error；--debug 时为 debug
+}
+
+// AuditConfig 审计日志配置
+type AuditConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Path       string `json:"path"`         // 日志文件，默认为状态目录下的 audit.jsonl
+	MaxSizeMB  int    `json:"max_size_mb"`  // 单个文件超过这么多MB后轮转，0表示不轮转
+	MaxFiles   int    `json:"max_files"`    // 保留的旧文件个数
+	Capture    string `json:"capture"`      // prompt和回答的记录方式："full" 原文、"hash" HMAC-SHA256（默认）、"omit" 不记录
+	HashKeyEnv string `json:"hash_key_env"` // hash 使用的HMAC密钥（base64编码的32字节）所在环境变量，默认 ULLM_AUDIT_KEY
+}
+
+// 全局配置
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		StateDir:        defaultStateDir(),
+		ShutdownTimeout: Duration(30 * time.Second),
+		Upstream: UpstreamConfig{
+			Timeout:               Duration(5 * time.Minute),
+			DialTimeout:           Duration(10 * time.Second),
+			KeepAlive:             Duration(30 * time.Second),
+			TLSHandshakeTimeout:   Duration(10 * time.Second),
+			ResponseHeaderTimeout: Duration(60 * time.Second),
+			IdleConnTimeout:       Duration(90 * time.Second),
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   32,
+		},
+		Retry: RetryConfig{
+			MaxAttempts: 3,
+			BaseDelay:   Duration(500 * time.Millisecond),
+			MaxDelay:    Duration(5 * time.Second),
+		},
+		Stream: StreamConfig{
+			HeartbeatInterval: Duration(15 * time.Second),
+			ResumeWindow:      Duration(5 * time.Minute),
+			ResumeGrace:       Duration(30 * time.Second),
+			Overflow:          "reject",
+			QueueTimeout:      Duration(30 * time.Second),
+		},
+		Assistants: AssistantConfig{
+			IDs:              aiAssistantIDs,
+			FailureThreshold: 3,
+			Cooldown:         Duration(time.Minute),
+		},
+		Concurrency: ConcurrencyConfig{
+			QueueTimeout: Duration(30 * time.Second),
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		Audit: AuditConfig{
+			MaxSizeMB: 100,
+			MaxFiles:  10,
+			Capture:   "hash",
+		},
+	}
+}
+
+// loadConfig 读取JSON配置文件，path为空时返回默认配置
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %v", err)
+	}
+
+	if cfg.StateDir == "" {
+		cfg.StateDir = defaultStateDir()
+	}
+	if cfg.Retry.MaxAttempts < 1 {
+		cfg.Retry.MaxAttempts = 1
+	}
+	if len(cfg.Assistants.IDs) == 0 {
+		return nil, fmt.Errorf("assistants.ids 不能为空")
+	}
+	if cfg.Stream.Overflow != "reject" && cfg.Stream.Overflow != "queue" {
+		return nil, fmt.Errorf("stream.overflow 应为 reject 或 queue: %q", cfg.Stream.Overflow)
+	}
+	return cfg, nil
+}
+
+// defaultStateDir 按XDG规范返回状态目录：$XDG_STATE_HOME/ullm 或 ~/.local/state/ullm
+func defaultStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "ullm")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "ullm")
+	}
+	return filepath.Join(os.TempDir(), "ullm")
+}
+
+// Duration 在JSON中以 "500ms"、"2s" 形式书写的时长，纯数字按秒处理
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		seconds, numErr := strconv.ParseFloat(string(data), 64)
+		if numErr != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
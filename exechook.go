@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exec 钩子：把规范化请求或完整结果以JSON写入外部程序的stdin，从stdout读取修改后的内容或拒绝决定。
+// 每次调用启动一个新进程，因此只支持 before_upstream 和 after_complete 两个阶段，不处理逐段输出
+//
+//	stdin:  {"stage": "before_upstream", "request": {...}}
+//	        {"stage": "after_complete", "request": {...}, "response": {...}}
+//	stdout: {"action": "continue", "request": {"prompt": "..."}, "response": {"text": "..."}}
+//	        {"action": "reject", "status": 403, "message": "..."}
+//
+// stdout为空等同于 {"action": "continue"}，未给出的字段保持不变
+type execHook struct {
+	Command []string `json:"command"`  // 程序及参数
+	Stages  []string `json:"stages"`   // 运行的阶段，默认两个阶段都运行
+	Timeout Duration `json:"timeout"`  // 单次调用超时，默认5秒
+	OnError string   `json:"on_error"` // 程序失败、超时或输出无法解析时："reject"（默认，返回503）或 "allow"（继续处理）
+}
+
+const (
+	hookStageBeforeUpstream = "before_upstream"
+	hookStageAfterComplete  = "after_complete"
+
+	// stderr 只保留开头部分用于日志
+	execHookMaxStderr = 4096
+)
+
+// 钩子程序超过 timeout 时的取消原因，用于与客户端断开区分
+var errExecHookTimeout = errors.New("exec hook timed out")
+
+// 外部程序的输入
+type execHookInput struct {
+	Stage    string             `json:"stage"`
+	Request  *CanonicalRequest  `json:"request"`
+	Response *CanonicalResponse `json:"response,omitempty"`
+}
+
+// 外部程序的输出，请求和结果中只有下列字段允许修改
+type execHookOutput struct {
+	Action  string `json:"action"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Request *struct {
+		Model     *string `json:"model"`
+		Prompt    *string `json:"prompt"`
+		MaxTokens *int    `json:"max_tokens"`
+	} `json:"request"`
+	Response *struct {
+		Text         *string `json:"text"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"response"`
+}
+
+func newExecHook(options json.RawMessage) (any, error) {
+	h := &execHook{
+		Stages:  []string{hookStageBeforeUpstream, hookStageAfterComplete},
+		Timeout: Duration(5 * time.Second),
+		// 护栏程序崩溃或卡住时默认拒绝请求，而不是放行
+		OnError: "reject",
+	}
+	if err := decodeHookOptions(options, h); err != nil {
+		return nil, err
+	}
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return nil, errors.New("command 不能为空")
+	}
+	if _, err := exec.LookPath(h.Command[0]); err != nil {
+		return nil, fmt.Errorf("找不到程序 %s: %v", h.Command[0], err)
+	}
+	for _, stage := range h.Stages {
+		if stage != hookStageBeforeUpstream && stage != hookStageAfterComplete {
+			return nil, fmt.Errorf("不支持的阶段 %q", stage)
+		}
+	}
+	if h.OnError != "allow" && h.OnError != "reject" {
+		return nil, fmt.Errorf("on_error 只能是 allow 或 reject")
+	}
+	if h.Timeout <= 0 {
+		return nil, errors.New("timeout 必须大于0")
+	}
+	return h, nil
+}
+
+func (h *execHook) BeforeUpstream(ctx context.Context, req *CanonicalRequest) error {
+	if !slices.Contains(h.Stages, hookStageBeforeUpstream) {
+		return nil
+	}
+	out, err := h.run(ctx, execHookInput{Stage: hookStageBeforeUpstream, Request: req})
+	if err != nil {
+		return h.failure(ctx, err)
+	}
+	if out.Action == "reject" {
+		return out.rejection()
+	}
+
+	if out.Request != nil {
+		// 无效的改写按程序失败处理，on_error=allow 时保留原请求
+		if model := out.Request.Model; model != nil && !ModelExists(*model) {
+			return h.failure(ctx, fmt.Errorf("invalid output: unknown model %q", *model))
+		}
+		if maxTokens := out.Request.MaxTokens; maxTokens != nil && *maxTokens < 1 {
+			return h.failure(ctx, errors.New("invalid output: max_tokens must be at least 1"))
+		}
+		if out.Request.Model != nil {
+			req.Model = *out.Request.Model
+		}
+		if out.Request.Prompt != nil {
+			req.Prompt = *out.Request.Prompt
+		}
+		if out.Request.MaxTokens != nil {
+			req.MaxTokens = out.Request.MaxTokens
+		}
+	}
+	return nil
+}
+
+// 流式请求的回答此时已发给客户端，修改只影响之后的结束事件和日志；拒绝会以错误事件结束流
+func (h *execHook) AfterComplete(ctx context.Context, req *CanonicalRequest, resp *CanonicalResponse) error {
+	if !slices.Contains(h.Stages, hookStageAfterComplete) {
+		return nil
+	}
+	out, err := h.run(ctx, execHookInput{Stage: hookStageAfterComplete, Request: req, Response: resp})
+	if err != nil {
+		return h.failure(ctx, err)
+	}
+	if out.Action == "reject" {
+		return out.rejection()
+	}
+
+	if out.Response != nil {
+		if out.Response.Text != nil {
+			resp.Text = *out.Response.Text
+			resp.Usage.CompletionTokens = estimateTokens(resp.Text)
+			resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+		}
+		if out.Response.FinishReason != nil {
+			resp.FinishReason = *out.Response.FinishReason
+		}
+	}
+	return nil
+}
+
+// 运行外部程序并解析输出
+func (h *execHook) run(ctx context.Context, input execHookInput) (*execHookOutput, error) {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, time.Duration(h.Timeout), errExecHookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// 程序的子进程可能继续占用输出管道，超时后不再等待
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		switch cause := context.Cause(ctx); {
+		case errors.Is(cause, errExecHookTimeout):
+			err = fmt.Errorf("timed out after %s", time.Duration(h.Timeout))
+		case cause != nil:
+			// 客户端断开或服务关闭，程序被提前终止
+			err = fmt.Errorf("cancelled: %w", cause)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			if len(msg) > execHookMaxStderr {
+				msg = msg[:execHookMaxStderr]
+			}
+			err = fmt.Errorf("%v (stderr: %s)", err, msg)
+		}
+		return nil, err
+	}
+
+	out := &execHookOutput{Action: "continue"}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return out, nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return nil, fmt.Errorf("invalid output: %v", err)
+	}
+	if out.Action != "continue" && out.Action != "reject" {
+		return nil, fmt.Errorf("invalid action %q", out.Action)
+	}
+	return out, nil
+}
+
+// 按 on_error 处理程序本身的失败
+func (h *execHook) failure(ctx context.Context, err error) error {
+	if h.OnError == "allow" {
+		slog.WarnContext(ctx, "exec hook failed, continuing", "command", h.Command[0], "err", err)
+		return nil
+	}
+	return &hookRejection{
+		Hook:    "exec",
+		Status:  http.StatusServiceUnavailable,
+		Message: fmt.Sprintf("%s failed: %v", h.Command[0], err),
+	}
+}
+
+func (out *execHookOutput) rejection() error {
+	status := out.Status
+	if status < 400 || status > 599 {
+		status = http.StatusForbidden
+	}
+	message := out.Message
+	if message == "" {
+		message = "request rejected"
+	}
+	return &hookRejection{Hook: "exec", Status: status, Message: message}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestExecHook(t *testing.T, options string) *execHook {
+	t.Helper()
+	h, err := newExecHook(json.RawMessage(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*execHook)
+}
+
+// 未设置 on_error 时，程序失败会拒绝请求而不是放行
+func TestExecHookFailsClosedByDefault(t *testing.T) {
+	h := newTestExecHook(t, `{"command": ["sh", "-c", "exit 1"]}`)
+	err := h.BeforeUpstream(context.Background(), &CanonicalRequest{Prompt: "hi"})
+	var rejection *hookRejection
+	if !errors.As(err, &rejection) || rejection.Status != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want 503 hookRejection", err)
+	}
+
+	allow := newTestExecHook(t, `{"command": ["sh", "-c", "exit 1"], "on_error": "allow"}`)
+	if err := allow.BeforeUpstream(context.Background(), &CanonicalRequest{Prompt: "hi"}); err != nil {
+		t.Fatalf("on_error=allow: err = %v", err)
+	}
+}
+
+func TestExecHookTimeout(t *testing.T) {
+	h := newTestExecHook(t, `{"command": ["sleep", "5"], "timeout": "50ms"}`)
+	start := time.Now()
+	_, err := h.run(context.Background(), execHookInput{Stage: hookStageBeforeUpstream, Request: &CanonicalRequest{}})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Fatalf("timeout took %s", time.Since(start))
+	}
+}
+
+// 客户端断开导致的取消不报告为超时
+func TestExecHookCancelledIsNotTimeout(t *testing.T) {
+	h := newTestExecHook(t, `{"command": ["sleep", "5"], "timeout": "10s"}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := h.run(ctx, execHookInput{Stage: hookStageBeforeUpstream, Request: &CanonicalRequest{}})
+	if err == nil || strings.Contains(err.Error(), "timed out") || !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want cancellation", err)
+	}
+}
+
+func TestExecHookRewriteAndReject(t *testing.T) {
+	rewrite := newTestExecHook(t, `{"command": ["sh", "-c", "cat >/dev/null; echo '{\"action\":\"continue\",\"request\":{\"prompt\":\"rewritten\"}}'"]}`)
+	req := &CanonicalRequest{Prompt: "original"}
+	if err := rewrite.BeforeUpstream(context.Background(), req); err != nil || req.Prompt != "rewritten" {
+		t.Fatalf("prompt = %q, err = %v", req.Prompt, err)
+	}
+
+	reject := newTestExecHook(t, `{"command": ["sh", "-c", "cat >/dev/null; echo '{\"action\":\"reject\",\"status\":451,\"message\":\"nope\"}'"]}`)
+	err := reject.BeforeUpstream(context.Background(), &CanonicalRequest{Prompt: "x"})
+	var rejection *hookRejection
+	if !errors.As(err, &rejection) || rejection.Status != 451 || rejection.Message != "nope" {
+		t.Fatalf("err = %v, want 451 nope", err)
+	}
+}
+
+// 钩子改写出的无效请求按钩子故障处理，不会发往上游
+func TestExecHookInvalidRewrite(t *testing.T) {
+	execHookPrinting := func(output, onError string) *execHook {
+		script := fmt.Sprintf("cat >/dev/null; echo '%s'", output)
+		return newTestExecHook(t, fmt.Sprintf(`{"command": ["sh", "-c", %q], "on_error": %q}`, script, onError))
+	}
+	for _, output := range []string{
+		`{"request":{"model":"gpt-9"}}`,
+		`{"request":{"max_tokens":0}}`,
+		`{"request":{"prompt":" "}}`,
+	} {
+		chain := &hookChain{names: []string{"exec"}, hooks: []any{execHookPrinting(output, "reject")}}
+		maxTokens := 10
+		err := chain.BeforeUpstream(context.Background(), &CanonicalRequest{Model: "qwen", Prompt: "hi", MaxTokens: &maxTokens})
+		var rejection *hookRejection
+		if !errors.As(err, &rejection) || upstreamErrorStatus(err) != http.StatusServiceUnavailable {
+			t.Errorf("output %s: err = %v, want a 503 hook failure", output, err)
+		}
+	}
+
+	// on_error=allow 时忽略无效的改写
+	maxTokens := 10
+	req := &CanonicalRequest{Model: "qwen", Prompt: "hi", MaxTokens: &maxTokens}
+	if err := execHookPrinting(`{"request":{"model":"gpt-9","max_tokens":0}}`, "allow").BeforeUpstream(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Model != "qwen" || *req.MaxTokens != 10 {
+		t.Fatalf("invalid rewrite applied: model %q, max_tokens %d", req.Model, *req.MaxTokens)
+	}
+}
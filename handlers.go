@@ -1,13 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,34 +18,22 @@ import (
 
 // 常量定义
 const (
-	APIURL      = "https://cloudsearchapi.ulearning.cn/kbChat/chat"
 	SessionSign = "2"
 	AskType     = "1"
-	FallbackMsg = "抱歉，我无法处理您的请求。请稍后再试。"
+
+	// 实际回答请求的模型（可能是备用模型）
+	ResolvedModelHeader = "X-Ullm-Resolved-Model"
 )
 
+// kbChat 接口地址，测试中替换为本地服务
+var chatAPIURL = "https://cloudsearchapi.ulearning.cn/kbChat/chat"
+
 // 全局调试标志
 var debugMode bool
 
-// AI助手ID池
-var aiAssistantIDs = []string{
-	"6", "27", "36", "37", "90", "95",
-	"119", "122", "509", "727", "959", "1788",
-}
-
-// 轮询索引
-var assistantIndex = 0
-
-// 轮询选择一个AI助手ID
-func getNextAssistantID() string {
-	id := aiAssistantIDs[assistantIndex]
-	assistantIndex = (assistantIndex + 1) % len(aiAssistantIDs)
-	return id
-}
-
 // 构建历史记录API URL
 func getHistoryAPIURL() string {
-	return fmt.Sprintf("https://cloudsearchapi.ulearning.cn/kbChat/historyList?assistantId=%s", getNextAssistantID())
+	return fmt.Sprintf("https://cloudsearchapi.ulearning.cn/kbChat/historyList?assistantId=%s", assistantPool.Next())
 }
 
 // 辅助函数：返回空历史记录
@@ -54,47 +45,20 @@ func returnEmptyHistory(w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(emptyHistory)
 }
 
-// 辅助函数：解析SSE数据
-func parseSSEData(line string) (string, bool) {
-	if !strings.HasPrefix(line, "data:") {
-		return "", false
-	}
-	jsonData := strings.TrimPrefix(line, "data:")
-	var streamResp struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal([]byte(jsonData), &streamResp); err != nil {
-		return "", false
-	}
-	return streamResp.Data, true
-}
-
-// 辅助函数：创建响应元数据
-func createResponseMetadata() (string, int64) {
-	now := time.Now().Unix()
-	return fmt.Sprintf("chatcmpl-%d", now), now
-}
-
 // 通用聊天处理参数
 type ChatProcessParams struct {
 	Model       string
 	Prompt      string
-	UserAPIKey  string
-	IsStream    bool
+	SessionID   string // 上游会话ID，为空时使用当前时间戳
+	AssistantID string // 上游assistantId，为空时从助手池中选择
 	RequestID   string
-	MaxTokens   *int     // Completions API 支持
-	Temperature *float64 // Completions API 支持
-	Stop        []string // Completions API 支持
+	// 允许使用的模型，为空表示不限制；不允许的备用模型会被跳过
+	AllowedModels []string
 }
 
 // 通用聊天处理函数 - 消除重复代码
-func processChatRequest(params ChatProcessParams) (*http.Response, error) {
-	// Get token for authentication
-	token, err := getToken()
-	if err != nil {
-		return nil, fmt.Errorf("auth failed: %v", err)
-	}
-
+// ctx结束（客户端断开或 upstream.timeout 到期）时上游请求随之取消
+func processChatRequest(ctx context.Context, params ChatProcessParams) (*http.Response, error) {
 	// Prepare request body
 	requestBody := map[string]any{
 		"query":  params.Prompt,
@@ -106,272 +70,180 @@ func processChatRequest(params ChatProcessParams) (*http.Response, error) {
 		return nil, fmt.Errorf("failed to marshal request body: %v", err)
 	}
 
-	// Create request to Ulearning API
-	apiReq, err := http.NewRequest("POST", APIURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	// Set required headers
-	apiReq.Header.Set("Authorization", token)
-	apiReq.Header.Set("Content-Type", "application/json;charset=UTF-8")
-
 	// Add query parameters
-	q := apiReq.URL.Query()
-	now := strconv.FormatInt(time.Now().Unix(), 10)
-	q.Add("sessionId", now)
-	q.Add("assistantId", getNextAssistantID())
+	q := url.Values{}
+	sessionID := params.SessionID
+	if sessionID == "" {
+		sessionID = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	q.Add("sessionId", sessionID)
+	assistantID := params.AssistantID
+	if assistantID == "" {
+		assistantID = assistantPool.Next()
+	}
+	q.Add("assistantId", assistantID)
 	q.Add("modelId", GetModelAPIID(params.Model))
 	q.Add("sessionSign", SessionSign)
 	q.Add("askType", AskType)
 	q.Add("requestId", params.RequestID)
-	apiReq.URL.RawQuery = q.Encode()
 
-	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(apiReq)
+	// 响应体关闭时取消请求，释放连接
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Send request, token失效时自动重新登录并重放
+	resp, err := doWithToken(upstreamClient, func(token string) (*http.Request, error) {
+		// Create request to Ulearning API
+		apiReq, err := http.NewRequestWithContext(ctx, "POST", chatAPIURL+"?"+q.Encode(), bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+
+		// Set required headers
+		apiReq.Header.Set("Authorization", token)
+		apiReq.Header.Set("Content-Type", "application/json;charset=UTF-8")
+		return apiReq, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %v", err)
+		cancel()
+		return nil, err
 	}
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, fmt.Errorf("API request failed with status: %d", resp.StatusCode)
+		cancel()
+		return nil, &upstreamStatusError{StatusCode: resp.StatusCode}
 	}
 
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
 	return resp, nil
 }
 
-var stopSignal = func() *string {
-	finishReason := "stop"
-	return &finishReason
-}()
-
-func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	// 生成请求ID用于追踪
-	requestID := fmt.Sprintf("req_%d", time.Now().UnixNano())
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// 关闭时同时取消请求上下文的响应体
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	// 检查并提取用户的API key
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		http.Error(w, "Unauthorized: Missing Authorization header", http.StatusUnauthorized)
-		return
-	}
-	userApiKey := strings.TrimPrefix(auth, "Bearer ")
-	if userApiKey == auth { // 如果没有Bearer前缀
-		userApiKey = auth
-	}
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
 
-	// 读取请求体
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("[%s] ERROR: Failed to read request body: %v", requestID, err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
+// 上游返回非200状态码
+type upstreamStatusError struct {
+	StatusCode int
+}
 
-	// 解析请求体
-	var req ChatCompletionsRequest
-	if json.Unmarshal(body, &req) != nil {
-		log.Printf("[%s] ERROR: Invalid JSON payload: %v", requestID, err)
-		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
-		return
-	}
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("API request failed with status: %d", e.StatusCode)
+}
 
-	// 关键信息日志 - 一行搞定
-	log.Printf("[%s] model=%s msgs=%d stream=%v user=%.8s",
-		requestID, req.Model, len(req.Messages),
-		req.Stream != nil && *req.Stream, userApiKey)
+// 上游流结束时没有任何有效内容
+var errEmptyAnswer = errors.New("upstream returned an empty answer")
 
-	// 调用 Ulearning API
-	// Get token for authentication
-	token, err := getToken()
-	if err != nil {
-		log.Printf("[%s] ERROR: Auth failed: %v", requestID, err)
-		http.Error(w, fmt.Sprintf("Failed to get token: %v", err), http.StatusInternalServerError)
-		return
+// 根据上游错误选择返回给客户端的状态码
+func upstreamErrorStatus(err error) int {
+	var rejection *hookRejection
+	if errors.As(err, &rejection) {
+		return rejection.Status
 	}
-
-	// 使用统一的prompt提取函数
-	finalPrompt := extractFinalPrompt(req.Messages)
-	if finalPrompt == "" {
-		// 如果统一函数返回空，使用最后一条消息作为fallback
-		lastMessage := req.Messages[len(req.Messages)-1]
-		finalPrompt = extractTextContent(lastMessage.Content)
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		// 上游的4xx（包括重新登录后仍然401/403）是代理自身账号或请求转换的问题，
+		// 原样返回会让客户端误以为自己的key无效；重试用尽后的5xx原样返回则无法与代理自身的503区分
+		return http.StatusBadGateway
 	}
-
-	// Prepare request body
-	requestBody := map[string]any{
-		"query":  finalPrompt,
-		"images": []string{},
+	var streamErr *upstreamStreamError
+	if errors.As(err, &streamErr) || errors.Is(err, errSSEEventTooLarge) {
+		return http.StatusBadGateway
 	}
-
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		http.Error(w, "Failed to marshal request body", http.StatusInternalServerError)
-		return
+	if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		return http.StatusServiceUnavailable
 	}
-
-	// Create request to Ulearning API
-	apiReq, err := http.NewRequest("POST", APIURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
 	}
-
-	// Set required headers
-	apiReq.Header.Set("Authorization", token)
-	apiReq.Header.Set("Content-Type", "application/json;charset=UTF-8")
-
-	// Add query parameters
-	q := apiReq.URL.Query()
-	q.Add("sessionId", userApiKey) // 使用用户的API key作为sessionId
-	q.Add("assistantId", getNextAssistantID())
-	q.Add("modelId", GetModelAPIID(req.Model))
-	q.Add("sessionSign", SessionSign)
-	q.Add("askType", AskType)
-	q.Add("requestId", strconv.FormatInt(time.Now().Unix(), 10))
-	apiReq.URL.RawQuery = q.Encode()
-
-	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(apiReq)
-	if err != nil {
-		log.Printf("[%s] ERROR: API request failed: %v", requestID, err)
-		http.Error(w, fmt.Sprintf("Failed to send request: %v", err), http.StatusInternalServerError)
-		return
+	if errors.Is(err, errEmptyAnswer) || errors.Is(err, errUpstreamRequest) {
+		return http.StatusBadGateway
 	}
-	defer resp.Body.Close()
+	return http.StatusInternalServerError
+}
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[%s] ERROR: API status %d", requestID, resp.StatusCode)
-		http.Error(w, fmt.Sprintf("API request failed with status: %d", resp.StatusCode), resp.StatusCode)
-		return
+// 将上游调用失败转换为返回给客户端的错误；客户端已断开时返回nil
+func upstreamFailure(ctx context.Context, err error) *streamFailure {
+	switch {
+	case isShuttingDown(ctx):
+		slog.WarnContext(ctx, "server shutting down before upstream answered")
+		return &streamFailure{status: http.StatusServiceUnavailable, message: errServerShutdown.Error(), code: "server_shutdown"}
+	case ctx.Err() != nil:
+		slog.InfoContext(ctx, "client disconnected before upstream answered")
+		return nil
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		slog.WarnContext(ctx, "upstream overloaded", "err", err)
+		return &streamFailure{status: http.StatusServiceUnavailable, message: err.Error(), code: "server_overloaded"}
+	default:
+		slog.ErrorContext(ctx, "upstream request failed", "err", err)
+		return &streamFailure{status: upstreamErrorStatus(err), message: err.Error(), code: "upstream_error"}
 	}
+}
 
-	// 检查是否为流式请求
-	if req.Stream != nil && *req.Stream {
-		// 流式响应：实时转发数据
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			return
-		}
-
-		// 生成响应ID和时间戳
-		responseID, createdTime := createResponseMetadata()
-
-		// 实时转发流式数据
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			if data, ok := parseSSEData(scanner.Text()); ok && data != "" {
-				// 转换为OpenAI格式并立即发送
-				chunkResp := ChatCompletionChunk{
-					ID:      responseID,
-					Object:  "chat.completion.chunk",
-					Created: createdTime,
-					Model:   req.Model,
-					Choices: []StreamChoice{{
-						Delta:        Delta{Content: data},
-						FinishReason: nil, // 中间消息的finish_reason为null
-						Index:        0,
-					}},
-				}
-
-				chunkData, _ := json.Marshal(chunkResp)
-				fmt.Fprintf(w, "data: %s\n\n", string(chunkData))
-				flusher.Flush()
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			log.Printf("[%s] ERROR: Stream read failed: %v", requestID, err)
-		}
-
-		// 发送结束标记
-		finishReason := "stop"
-		finishResp := ChatCompletionChunk{
-			ID:      responseID,
-			Object:  "chat.completion.chunk",
-			Created: createdTime,
-			Model:   req.Model,
-			Choices: []StreamChoice{
-				{
-					Delta:        Delta{},
-					Index:        0,
-					FinishReason: &finishReason,
-				},
-			},
-		}
+// 检查转发结束的原因；流被中断时写出错误事件并返回false
+func streamEndedCleanly(ctx context.Context, sink streamSink, streamErr error) bool {
+	switch {
+	case isShuttingDown(ctx):
+		slog.WarnContext(ctx, "stream interrupted by server shutdown")
+		sink.WriteError(errServerShutdown.Error(), "server_shutdown")
+		return false
+	case ctx.Err() != nil:
+		slog.InfoContext(ctx, "stream cancelled, upstream stopped")
+		return false
+	case streamErr != nil:
+		slog.ErrorContext(ctx, "stream read failed", "err", streamErr)
+		sink.WriteError(streamErr.Error(), "upstream_error")
+		return false
+	}
+	return true
+}
 
-		finishData, _ := json.Marshal(finishResp)
-		fmt.Fprintf(w, "data: %s\n\n", string(finishData))
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		flusher.Flush()
-
-		log.Printf("[%s] SUCCESS: stream completed", requestID)
-	} else {
-		// 非流式响应：收集完整内容
-		scanner := bufio.NewScanner(resp.Body)
-		var fullContent string
-		for scanner.Scan() {
-			if data, ok := parseSSEData(scanner.Text()); ok {
-				fullContent += data
+// 按模型的备用链依次请求上游，每个模型按重试配置尝试，直到拿到非空回答
+// 切换只发生在向客户端写出任何字节之前；返回实际回答的模型ID
+func processChatRequestWithFallback(ctx context.Context, params ChatProcessParams) (*kbChatStream, string, error) {
+	// 请求的模型已在入口检查过，这里只过滤备用模型，避免受限的key经备用链用到未授权的模型
+	chain := GetModelChain(params.Model)
+	if len(params.AllowedModels) > 0 {
+		chain = slices.DeleteFunc(chain, func(model string) bool {
+			return model != params.Model && !slices.Contains(params.AllowedModels, model)
+		})
+	}
+
+	var lastErr error
+	for i, model := range chain {
+		attempt := params
+		attempt.Model = model
+
+		stream, err := requestModelWithRetry(ctx, attempt, config.Retry)
+		if err == nil {
+			if model != params.Model {
+				slog.InfoContext(ctx, "answered by fallback model", "model", params.Model, "fallback", model)
 			}
+			return stream, model, nil
 		}
 
-		if err := scanner.Err(); err != nil {
-			log.Printf("[%s] ERROR: Response stream failed: %v", requestID, err)
-			http.Error(w, "Failed to read response stream", http.StatusInternalServerError)
-			return
+		lastErr = err
+		if ctx.Err() != nil {
+			// 客户端已断开，不再尝试备用模型
+			return nil, "", err
 		}
-
-		// 检查并处理空内容
-		if strings.TrimSpace(fullContent) == "" {
-			fullContent = FallbackMsg
-			log.Printf("[%s] WARN: Empty response, using fallback", requestID)
-		}
-
-		// Convert to OpenAI API format
-		openAIResp := ChatCompletionsResponse{
-			ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-			Object:  "chat.completion",
-			Created: time.Now().Unix(),
-			Model:   req.Model,
-			Usage: Usage{
-				PromptTokens:     0, // Token counts not available
-				CompletionTokens: 0, // Token counts not available
-				TotalTokens:      0, // Token counts not available
-			},
-			Choices: []Choice{
-				{
-					Message: Message{
-						Role:    "assistant",
-						Content: fullContent,
-					},
-					FinishReason: stopSignal,
-					Index:        0,
-				},
-			},
+		if i < len(chain)-1 {
+			upstreamFallbacks.Add(1)
+			slog.WarnContext(ctx, "model failed, falling back", "model", model, "fallback", chain[i+1], "err", err)
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(openAIResp)
-
-		log.Printf("[%s] SUCCESS: response_len=%d", requestID, len(fullContent))
 	}
+
+	upstreamExhausted.Add(1)
+	return nil, "", fmt.Errorf("all upstream attempts failed (models=%s): %w", strings.Join(chain, ","), lastErr)
 }
 
 func handleModels(w http.ResponseWriter, r *http.Request) {
@@ -380,271 +252,61 @@ func handleModels(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 返回可用模型列表
+	// 返回当前key可用的模型列表
+	models := []Model{}
+	key := apiKeyFromContext(r.Context())
+	for _, model := range GetAvailableModels() {
+		if key == nil || key.AllowsModel(model.ID) {
+			models = append(models, model)
+		}
+	}
 	modelsResp := ModelsResponse{
 		Object: "list",
-		Data:   GetAvailableModels(),
+		Data:   models,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(modelsResp)
 }
 
-func handleResponses(w http.ResponseWriter, r *http.Request) {
-	// 生成请求ID用于追踪
-	requestID := fmt.Sprintf("req_%d", time.Now().UnixNano())
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// 检查并提取用户的API key
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		http.Error(w, "Unauthorized: Missing Authorization header", http.StatusUnauthorized)
-		return
-	}
-	userApiKey := strings.TrimPrefix(auth, "Bearer ")
-	if userApiKey == auth {
-		userApiKey = auth
-	}
-
-	// 读取请求体
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("[%s] ERROR: Failed to read request body: %v", requestID, err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-
-	// 解析请求体
-	var req ResponsesRequest
-	if json.Unmarshal(body, &req) != nil {
-		log.Printf("[%s] ERROR: Invalid JSON payload: %v", requestID, err)
-		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	// 提取prompt内容，使用统一的prompt提取函数
-	var prompt string
-	switch input := req.Input.(type) {
-	case string:
-		// 简单文本输入
-		prompt = input
-	case []interface{}:
-		// 多模态输入 - 使用统一的prompt提取函数
-		prompt = extractFinalPrompt(input)
-		if prompt == "" {
-			// 如果统一函数返回空，使用原有逻辑作为fallback
-			for _, item := range input {
-				if msgMap, ok := item.(map[string]interface{}); ok {
-					if role, exists := msgMap["role"]; exists && role == "user" {
-						if content, exists := msgMap["content"]; exists {
-							if contentArray, ok := content.([]interface{}); ok {
-								for _, contentItem := range contentArray {
-									if contentMap, ok := contentItem.(map[string]interface{}); ok {
-										if contentType, exists := contentMap["type"]; exists && contentType == "input_text" {
-											if text, exists := contentMap["text"]; exists {
-												if textStr, ok := text.(string); ok {
-													prompt = textStr
-													break
-												}
-											}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	default:
-		prompt = fmt.Sprintf("%v", input)
-	}
-
-	if prompt == "" {
-		http.Error(w, "No valid input found", http.StatusBadRequest)
-		return
-	}
-
-	// 关键信息日志
-	log.Printf("[%s] model=%s prompt_len=%d stream=%v user=%.8s",
-		requestID, req.Model, len(prompt),
-		req.Stream != nil && *req.Stream, userApiKey)
-
-	// 使用通用处理函数
-	params := ChatProcessParams{
-		Model:      req.Model,
-		Prompt:     prompt,
-		UserAPIKey: userApiKey,
-		IsStream:   req.Stream != nil && *req.Stream,
-		RequestID:  requestID,
-	}
-
-	resp, err := processChatRequest(params)
-	if err != nil {
-		log.Printf("[%s] ERROR: %v", requestID, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// 生成响应ID和时间戳
-	responseID, createdTime := createResponseMetadata()
-
-	// 检查是否为流式请求
-	if req.Stream != nil && *req.Stream {
-		// 流式响应
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			return
-		}
-
-		// 实时转发流式数据
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			if data, ok := parseSSEData(scanner.Text()); ok && data != "" {
-				// 转换为统一的 delta 格式
-				chunkResp := UnifiedStreamChunk{
-					ID:    responseID,
-					Type:  "response.output_text.delta",
-					Delta: data,
-				}
-
-				chunkData, _ := json.Marshal(chunkResp)
-				fmt.Fprintf(w, "data: %s\n\n", string(chunkData))
-				flusher.Flush()
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			log.Printf("[%s] ERROR: Stream read failed: %v", requestID, err)
-		}
-
-		// 发送完成标记
-		completedResp := UnifiedStreamChunk{
-			ID:   responseID,
-			Type: "response.completed",
-		}
-		completedData, _ := json.Marshal(completedResp)
-		fmt.Fprintf(w, "data: %s\n\n", string(completedData))
-
-		// 发送结束标记
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		flusher.Flush()
-
-		log.Printf("[%s] SUCCESS: stream completed", requestID)
-	} else {
-		// 非流式响应
-		scanner := bufio.NewScanner(resp.Body)
-		var fullContent string
-		for scanner.Scan() {
-			if data, ok := parseSSEData(scanner.Text()); ok {
-				fullContent += data
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			log.Printf("[%s] ERROR: Response stream failed: %v", requestID, err)
-			http.Error(w, "Failed to read response stream", http.StatusInternalServerError)
-			return
-		}
-
-		// 检查并处理空内容
-		if strings.TrimSpace(fullContent) == "" {
-			fullContent = FallbackMsg
-			log.Printf("[%s] WARN: Empty response, using fallback", requestID)
-		}
-
-		// 转换为 Responses API 格式
-		responsesResp := ResponsesResponse{
-			ID:      responseID,
-			Object:  "response",
-			Created: createdTime,
-			Model:   req.Model,
-			Output: []ResponsesOutputMessage{{
-				ID:   "msg_1",
-				Type: "message",
-				Role: "assistant",
-				Content: []ResponsesOutputContent{{
-					Type: "output_text",
-					Text: fullContent,
-				}},
-			}},
-			Usage: Usage{
-				PromptTokens:     0, // Token counts not available
-				CompletionTokens: 0, // Token counts not available
-				TotalTokens:      0, // Token counts not available
-			},
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(responsesResp)
-
-		log.Printf("[%s] SUCCESS: response_len=%d", requestID, len(fullContent))
-	}
-}
-
 func handleOpenAIHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// 检查Authorization header
-	auth, err := getToken()
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// 从Authorization header中提取token
-	token := strings.TrimPrefix(auth, "Bearer ")
-
-	// 调用kbChat API获取历史记录
+	// 调用kbChat API获取历史记录，token失效时自动重新登录
 	historyURL := getHistoryAPIURL()
-	req, err := http.NewRequest("GET", historyURL, nil)
-	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		returnEmptyHistory(w)
-		return
-	}
-
-	// 设置请求头
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Content-Type", "application/json")
-	log.Printf("Calling kbChat API: %s with token: %s", historyURL, token)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	resp, err := doWithToken(upstreamClient, func(token string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", historyURL, nil)
+		if err != nil {
+			return nil, err
+		}
 
-	// 发送请求
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+		// 设置请求头
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
-		log.Printf("Failed to fetch history from kbChat API: %v", err)
+		slog.ErrorContext(r.Context(), "failed to fetch history from kbChat API", "err", err)
 		returnEmptyHistory(w)
 		return
 	}
 	defer resp.Body.Close()
 
-	log.Printf("kbChat API response status: %d", resp.StatusCode)
-
 	// 读取响应
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("Failed to read response: %v", err)
+		slog.ErrorContext(r.Context(), "failed to read history response", "err", err)
 		returnEmptyHistory(w)
 		return
 	}
 
-	log.Printf("kbChat API response body: %s", string(body))
+	slog.DebugContext(r.Context(), "kbChat history response", "status", resp.StatusCode, "body_len", len(body))
 
 	// 检查API响应状态
 	if resp.StatusCode != 200 {
-		log.Printf("kbChat API returned non-200 status: %d, returning empty history", resp.StatusCode)
+		slog.WarnContext(r.Context(), "kbChat history returned non-200 status, returning empty history", "status", resp.StatusCode)
 		returnEmptyHistory(w)
 		return
 	}
@@ -652,7 +314,7 @@ func handleOpenAIHistory(w http.ResponseWriter, r *http.Request) {
 	// 解析kbChat API响应
 	var historyResp HistoryResponse
 	if err := json.Unmarshal(body, &historyResp); err != nil {
-		log.Printf("Failed to parse history response: %v, body: %s", err, string(body))
+		slog.ErrorContext(r.Context(), "failed to parse history response", "err", err, "body_len", len(body))
 		returnEmptyHistory(w)
 		return
 	}
@@ -706,43 +368,11 @@ func handleOpenAIHistory(w http.ResponseWriter, r *http.Request) {
 func logMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if debugMode {
-			// 调试模式：记录详细信息
-			log.Printf("[DEBUG] %s %s %s - Headers: %v", r.Method, r.URL.Path, r.RemoteAddr, r.Header)
+			// 调试模式：记录请求头，认证相关的头被替换
+			slog.DebugContext(r.Context(), "received request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "headers", redactHeaders(r.Header))
 		} else {
-			// 普通模式：只记录基本信息
-			log.Printf("Received request: %s %s", r.Method, r.URL.Path)
+			slog.InfoContext(r.Context(), "received request", "method", r.Method, "path", r.URL.Path)
 		}
 		handler(w, r)
 	}
 }
-
-func startServer(port int, debug bool) error {
-	// 设置全局调试模式
-	debugMode = debug
-
-	// 注册带日志中间件的路由
-	http.HandleFunc("/v1/chat/completions", logMiddleware(handleChatCompletions))
-	http.HandleFunc("/v1/models", logMiddleware(handleModels))
-	http.HandleFunc("/v1/chat/history", logMiddleware(handleOpenAIHistory))
-	http.HandleFunc("/v1/responses", logMiddleware(handleResponses))
-
-	// 处理404情况
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if debugMode {
-			log.Printf("[DEBUG] %s %s %s - Headers: %v", r.Method, r.URL.Path, r.RemoteAddr, r.Header)
-			log.Printf("[DEBUG] 404 Not Found: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
-		} else {
-			log.Printf("Received request: %s %s", r.Method, r.URL.Path)
-		}
-		http.NotFound(w, r)
-	})
-
-	addr := fmt.Sprintf(":%d", port)
-	fmt.Printf("服务器启动在 http://0.0.0.0%s\n", addr)
-	fmt.Printf("可用接口:\n")
-	fmt.Printf("  POST http://0.0.0.0%s/v1/chat/completions - 聊天完成\n", addr)
-	fmt.Printf("  POST http://0.0.0.0%s/v1/responses - OpenAI统一响应接口\n", addr)
-	fmt.Printf("  GET  http://0.0.0.0%s/v1/models - 模型列表\n", addr)
-	fmt.Printf("  GET  http://0.0.0.0%s/v1/chat/history - OpenAI格式历史记录\n", addr)
-	return http.ListenAndServe(addr, nil)
-}
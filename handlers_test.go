@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useUpstream 在测试期间把kbChat接口指向本地服务，token固定为 "tok"，重试等待缩短到毫秒级
+func useUpstream(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	savedURL, savedClient, savedTokens, savedConfig := chatAPIURL, upstreamClient, tokenManager, config
+	chatAPIURL = srv.URL
+	upstreamClient = srv.Client()
+	tokenManager = NewTokenManager(&memoryTokenStore{}, func() (string, error) { return "tok", nil })
+	copied := *config
+	copied.Retry = RetryConfig{MaxAttempts: 2, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(2 * time.Millisecond)}
+	config = &copied
+	t.Cleanup(func() {
+		chatAPIURL, upstreamClient, tokenManager, config = savedURL, savedClient, savedTokens, savedConfig
+	})
+}
+
+// writeKBChatAnswer 以kbChat的SSE格式返回回答片段
+func writeKBChatAnswer(w http.ResponseWriter, chunks ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, chunk := range chunks {
+		data, _ := json.Marshal(map[string]string{"data": chunk})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// 记录上游依次收到的 modelId
+type modelLog struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (l *modelLog) add(r *http.Request) string {
+	id := r.URL.Query().Get("modelId")
+	l.mu.Lock()
+	l.ids = append(l.ids, id)
+	l.mu.Unlock()
+	return id
+}
+
+func (l *modelLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.ids)
+}
+
+func readStream(t *testing.T, s *kbChatStream) string {
+	t.Helper()
+	defer s.Close()
+	var text strings.Builder
+	for {
+		chunk, err := s.Next()
+		if err == io.EOF {
+			return text.String()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		text.WriteString(chunk)
+	}
+}
+
+func TestGetModelChain(t *testing.T) {
+	if got, want := GetModelChain("deepseek-r1-local"), []string{"deepseek-r1-local", "deepseek-r1", "deepseek-v3.1"}; !slices.Equal(got, want) {
+		t.Fatalf("chain = %v, want %v", got, want)
+	}
+	if got := GetModelChain("unknown"); !slices.Equal(got, []string{"unknown"}) {
+		t.Fatalf("unknown model chain = %v", got)
+	}
+
+	saved := ModelConfigs
+	ModelConfigs = []ModelConfig{{ID: "a", Fallbacks: []string{"b", "a", "c", "b"}}}
+	t.Cleanup(func() { ModelConfigs = saved })
+	if got, want := GetModelChain("a"), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Fatalf("chain with duplicates = %v, want %v", got, want)
+	}
+}
+
+// 请求模型重试用尽后按顺序尝试备用模型，返回实际回答的模型
+func TestFallbackToNextModel(t *testing.T) {
+	var requested modelLog
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if requested.add(r) == "6" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeKBChatAnswer(w, "from ", "fallback")
+	})
+
+	stream, model, err := processChatRequestWithFallback(context.Background(), ChatProcessParams{Model: "deepseek-r1-local", Prompt: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := readStream(t, stream); model != "deepseek-r1" || text != "from fallback" {
+		t.Fatalf("answered by %s: %q", model, text)
+	}
+	if got, want := requested.get(), []string{"6", "6", "3"}; !slices.Equal(got, want) {
+		t.Fatalf("upstream modelIds = %v, want %v", got, want)
+	}
+}
+
+func TestFallbackExhausted(t *testing.T) {
+	var requested modelLog
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		requested.add(r)
+		writeKBChatAnswer(w) // 空回答
+	})
+
+	_, _, err := processChatRequestWithFallback(context.Background(), ChatProcessParams{Model: "qwen", Prompt: "hi"})
+	if !errors.Is(err, errEmptyAnswer) || !strings.Contains(err.Error(), "models=qwen,doubao") {
+		t.Fatalf("err = %v", err)
+	}
+	if got, want := requested.get(), []string{"1", "1", "2", "2"}; !slices.Equal(got, want) {
+		t.Fatalf("upstream modelIds = %v, want %v", got, want)
+	}
+	if status := upstreamErrorStatus(err); status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", status)
+	}
+}
+
+// 客户端断开后不再尝试备用模型
+func TestFallbackStopsWhenClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var requested modelLog
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		requested.add(r)
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if _, _, err := processChatRequestWithFallback(ctx, ChatProcessParams{Model: "qwen", Prompt: "hi"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := requested.get(); len(got) != 1 {
+		t.Fatalf("upstream called %d times after the client left: %v", len(got), got)
+	}
+}
+
+// upstream.timeout 覆盖整个请求：上游挂起时到期即返回504，不再重试或切换备用模型
+func TestUpstreamTimeoutCoversWholeRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		partial string
+	}{
+		{"hangs before answering", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}, ""},
+		{"hangs mid-stream", func(w http.ResponseWriter, r *http.Request) {
+			data, _ := json.Marshal(map[string]string{"data": "partial"})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}, "partial"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requested modelLog
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				requested.add(r)
+				io.Copy(io.Discard, r.Body) // 读完请求体后服务端才能察觉客户端断开
+				tc.handler(w, r)
+			})
+			copied := *config
+			copied.Upstream.Timeout = Duration(50 * time.Millisecond)
+			copied.Retry.MaxAttempts = 3
+			config = &copied
+
+			start := time.Now()
+			var text strings.Builder
+			_, err := runPipeline(context.Background(), &CanonicalRequest{Model: "qwen", Prompt: "hi"}, "chatcmpl",
+				func(_ *CanonicalResponse, delta string) { text.WriteString(delta) })
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("request took %s", elapsed)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) || upstreamErrorStatus(err) != http.StatusGatewayTimeout {
+				t.Fatalf("err = %v (status %d), want a 504 deadline error", err, upstreamErrorStatus(err))
+			}
+			if got := requested.get(); !slices.Equal(got, []string{"1"}) {
+				t.Fatalf("upstream modelIds = %v, want a single attempt", got)
+			}
+			if text.String() != tc.partial {
+				t.Fatalf("text = %q, want %q", text.String(), tc.partial)
+			}
+		})
+	}
+}
+
+// 限定模型的key不会经备用链用到未授权的模型
+func TestFallbackRespectsAllowedModels(t *testing.T) {
+	var requested modelLog
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if requested.add(r) == "6" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeKBChatAnswer(w, "ok")
+	})
+	key := &APIKey{ID: "k", Enabled: true, AllowedModels: []string{"deepseek-r1-local", "deepseek-v3.1"}}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"deepseek-r1-local","messages":[{"role":"user","content":"hi"}]}`))
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+	rec := httptest.NewRecorder()
+	handleChatCompletions(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	// deepseek-r1 (3) 不在允许列表中，被跳过
+	if got, want := requested.get(), []string{"6", "6", "7"}; !slices.Equal(got, want) {
+		t.Fatalf("upstream modelIds = %v, want %v", got, want)
+	}
+
+	// 允许列表中没有任何备用模型时只尝试请求的模型
+	requested = modelLog{}
+	_, _, err := processChatRequestWithFallback(context.Background(), ChatProcessParams{
+		Model: "deepseek-r1-local", Prompt: "hi", AllowedModels: []string{"deepseek-r1-local"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "(models=deepseek-r1-local)") {
+		t.Fatalf("err = %v", err)
+	}
+	if got := requested.get(); !slices.Equal(got, []string{"6", "6"}) {
+		t.Fatalf("upstream modelIds = %v", got)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// 钩子在请求处理管线的固定位置运行，用于改写prompt、过滤输出或审计，而不必修改各接口的处理函数。
+// 一个钩子实现以下任意几个接口即可，未实现的阶段直接跳过。钩子在所有请求间共享，必须可并发调用
+
+// BeforeUpstreamHook 在调用上游前检查或改写规范化请求，返回错误时拒绝请求
+type BeforeUpstreamHook interface {
+	BeforeUpstream(ctx context.Context, req *CanonicalRequest) error
+}
+
+// DeltaHook 改写发给客户端的每段增量文本，返回空字符串表示丢弃该段
+type DeltaHook interface {
+	OnDelta(ctx context.Context, req *CanonicalRequest, text string) (string, error)
+}
+
+// AfterCompleteHook 在生成结束、发送结束事件之前查看或修改完整结果
+type AfterCompleteHook interface {
+	AfterComplete(ctx context.Context, req *CanonicalRequest, resp *CanonicalResponse) error
+}
+
+// HookConfig 配置文件中的一个钩子
+type HookConfig struct {
+	Type    string          `json:"type"`    // 钩子类型，见 hookFactories
+	Options json.RawMessage `json:"options"` // 该类型钩子的参数
+}
+
+// 钩子拒绝请求，Status为返回给客户端的状态码
+type hookRejection struct {
+	Hook    string
+	Status  int
+	Message string
+}
+
+func (e *hookRejection) Error() string {
+	return fmt.Sprintf("rejected by hook %s: %s", e.Hook, e.Message)
+}
+
+// 内置钩子类型
+var hookFactories = map[string]func(options json.RawMessage) (any, error){
+	"prompt_template": newPromptTemplateHook,
+	"max_prompt":      newMaxPromptHook,
+	"replace":         newReplaceHook,
+	"log":             newLogHook,
+	"exec":            newExecHook,
+}
+
+// hookChain 按配置顺序执行的钩子
+type hookChain struct {
+	names []string
+	hooks []any
+}
+
+// 全局钩子链，startServer 按配置初始化
+var pipelineHooks = &hookChain{}
+
+func newHookChain(cfgs []HookConfig) (*hookChain, error) {
+	chain := &hookChain{}
+	for i, cfg := range cfgs {
+		factory, ok := hookFactories[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("hooks[%d]: 未知的钩子类型 %q", i, cfg.Type)
+		}
+		hook, err := factory(cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("hooks[%d] (%s): %v", i, cfg.Type, err)
+		}
+		chain.names = append(chain.names, cfg.Type)
+		chain.hooks = append(chain.hooks, hook)
+	}
+	return chain, nil
+}
+
+func (c *hookChain) BeforeUpstream(ctx context.Context, req *CanonicalRequest) error {
+	for i, hook := range c.hooks {
+		if h, ok := hook.(BeforeUpstreamHook); ok {
+			if err := h.BeforeUpstream(ctx, req); err != nil {
+				return c.wrap(i, err)
+			}
+			// 客户端的请求已通过校验，钩子改写后无效属于钩子故障
+			if err := validateRequest(req); err != nil {
+				return &hookRejection{Hook: c.names[i], Status: http.StatusServiceUnavailable, Message: "invalid request after hook: " + err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *hookChain) OnDelta(ctx context.Context, req *CanonicalRequest, text string) (string, error) {
+	for i, hook := range c.hooks {
+		if text == "" {
+			break
+		}
+		if h, ok := hook.(DeltaHook); ok {
+			var err error
+			if text, err = h.OnDelta(ctx, req, text); err != nil {
+				return "", c.wrap(i, err)
+			}
+		}
+	}
+	return text, nil
+}
+
+func (c *hookChain) AfterComplete(ctx context.Context, req *CanonicalRequest, resp *CanonicalResponse) error {
+	for i, hook := range c.hooks {
+		if h, ok := hook.(AfterCompleteHook); ok {
+			if err := h.AfterComplete(ctx, req, resp); err != nil {
+				return c.wrap(i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 把钩子返回的普通错误包装为拒绝，便于按状态码返回给客户端
+func (c *hookChain) wrap(i int, err error) error {
+	var rejection *hookRejection
+	if errors.As(err, &rejection) {
+		return err
+	}
+	return &hookRejection{Hook: c.names[i], Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+// 严格解析钩子参数，拼错的字段名直接报错
+func decodeHookOptions(options json.RawMessage, v any) error {
+	if len(options) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// prompt_template 改写prompt：{{prompt}} 替换为原始prompt
+type promptTemplateHook struct {
+	Template string `json:"template"`
+}
+
+func newPromptTemplateHook(options json.RawMessage) (any, error) {
+	h := &promptTemplateHook{}
+	if err := decodeHookOptions(options, h); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(h.Template, "{{prompt}}") {
+		return nil, errors.New("template 必须包含 {{prompt}}")
+	}
+	return h, nil
+}
+
+func (h *promptTemplateHook) BeforeUpstream(ctx context.Context, req *CanonicalRequest) error {
+	req.Prompt = strings.ReplaceAll(h.Template, "{{prompt}}", req.Prompt)
+	return nil
+}
+
+// max_prompt 拒绝估算token数超过上限的prompt
+type maxPromptHook struct {
+	MaxTokens int `json:"max_tokens"`
+}
+
+func newMaxPromptHook(options json.RawMessage) (any, error) {
+	h := &maxPromptHook{}
+	if err := decodeHookOptions(options, h); err != nil {
+		return nil, err
+	}
+	if h.MaxTokens < 1 {
+		return nil, errors.New("max_tokens 必须大于0")
+	}
+	return h, nil
+}
+
+func (h *maxPromptHook) BeforeUpstream(ctx context.Context, req *CanonicalRequest) error {
+	if tokens := estimateTokens(req.Prompt); tokens > h.MaxTokens {
+		return &hookRejection{
+			Hook:    "max_prompt",
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("prompt is about %d tokens, limit is %d", tokens, h.MaxTokens),
+		}
+	}
+	return nil
+}
+
+// replace 按顺序替换输出中的字符串。替换在每段增量文本内进行，
+// 跨越两段的匹配不会被替换，适合屏蔽词语而不是长句
+type replaceHook struct {
+	Rules []struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"rules"`
+	replacer *strings.Replacer
+}
+
+func newReplaceHook(options json.RawMessage) (any, error) {
+	h := &replaceHook{}
+	if err := decodeHookOptions(options, h); err != nil {
+		return nil, err
+	}
+	if len(h.Rules) == 0 {
+		return nil, errors.New("rules 不能为空")
+	}
+	var oldnew []string
+	for _, rule := range h.Rules {
+		if rule.From == "" {
+			return nil, errors.New("rules 中的 from 不能为空")
+		}
+		oldnew = append(oldnew, rule.From, rule.To)
+	}
+	h.replacer = strings.NewReplacer(oldnew...)
+	return h, nil
+}
+
+func (h *replaceHook) OnDelta(ctx context.Context, req *CanonicalRequest, text string) (string, error) {
+	return h.replacer.Replace(text), nil
+}
+
+// log 每个请求结束时记录一行摘要，可选附带prompt和回答全文
+type logHook struct {
+	Content bool `json:"content"`
+}
+
+func newLogHook(options json.RawMessage) (any, error) {
+	h := &logHook{}
+	if err := decodeHookOptions(options, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *logHook) AfterComplete(ctx context.Context, req *CanonicalRequest, resp *CanonicalResponse) error {
+	attrs := []any{"hook", "log", "api", req.API, "model", req.Model,
+		"resolved", resp.ResolvedModel, "finish", resp.FinishReason,
+		"prompt_tokens", resp.Usage.PromptTokens, "completion_tokens", resp.Usage.CompletionTokens}
+	if h.Content {
+		attrs = append(attrs, "prompt", req.Prompt, "answer", resp.Text)
+	}
+	slog.InfoContext(ctx, "request completed", attrs...)
+	return nil
+}
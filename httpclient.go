@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// 所有上游请求共享的HTTP客户端，startServer 会按配置重新创建。
+// 不设置整体超时，由调用方通过context控制（流式响应可能持续数分钟）
+var upstreamClient = &http.Client{Transport: &tracingTransport{base: http.DefaultTransport}}
+
+// 上游连接统计，通过 /debug/vars 暴露
+var (
+	upstreamConnsNew    = expvar.NewInt("upstream_conns_new")
+	upstreamConnsReused = expvar.NewInt("upstream_conns_reused")
+	upstreamPhaseMillis = expvar.NewMap("upstream_phase_ms_total") // 各阶段累计耗时
+)
+
+// newUpstreamClient 根据配置创建带连接池和各阶段超时的HTTP客户端
+func newUpstreamClient(cfg UpstreamConfig) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(cfg.DialTimeout),
+		KeepAlive: time.Duration(cfg.KeepAlive),
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy_url: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream ca_file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: &tracingTransport{base: transport}}, nil
+}
+
+// tracingTransport 记录每个上游请求的连接复用情况和各阶段耗时
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// 单个上游请求的阶段时间点；httptrace回调可能在不同goroutine中触发，需加锁
+type upstreamTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &upstreamTrace{start: time.Now()}
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { trace.mark(&trace.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { trace.mark(&trace.dnsDone) },
+		ConnectStart:      func(string, string) { trace.mark(&trace.connectStart) },
+		ConnectDone:       func(string, string, error) { trace.mark(&trace.connectDone) },
+		TLSHandshakeStart: func() { trace.mark(&trace.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { trace.mark(&trace.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.mark(&trace.gotConn)
+			trace.mu.Lock()
+			trace.reused = info.Reused
+			trace.mu.Unlock()
+		},
+		GotFirstResponseByte: func() { trace.mark(&trace.firstByte) },
+	})
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		trace.observe(req)
+	}
+	return resp, err
+}
+
+// 记录某个阶段的时间点
+func (t *upstreamTrace) mark(at *time.Time) {
+	t.mu.Lock()
+	*at = time.Now()
+	t.mu.Unlock()
+}
+
+// 汇总本次请求的阶段耗时
+func (t *upstreamTrace) observe(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reused {
+		upstreamConnsReused.Add(1)
+	} else {
+		upstreamConnsNew.Add(1)
+	}
+
+	phases := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"dns", t.dnsStart, t.dnsDone},
+		{"connect", t.connectStart, t.connectDone},
+		{"tls", t.tlsStart, t.tlsDone},
+		{"wait_conn", t.start, t.gotConn},
+		{"first_byte", t.gotConn, t.firstByte},
+	}
+	for _, p := range phases {
+		if !p.start.IsZero() && !p.end.IsZero() {
+			upstreamPhaseMillis.Add(p.name, p.end.Sub(p.start).Milliseconds())
+		}
+	}
+
+	if debugMode {
+		slog.DebugContext(req.Context(), "upstream request timing", "method", req.Method, "path", req.URL.Path, "reused", t.reused,
+			"dns", phaseDuration(t.dnsStart, t.dnsDone),
+			"connect", phaseDuration(t.connectStart, t.connectDone),
+			"tls", phaseDuration(t.tlsStart, t.tlsDone),
+			"ttfb", phaseDuration(t.start, t.firstByte))
+	}
+}
+
+// 阶段未发生时返回0
+func phaseDuration(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 新密钥的前缀，便于在日志和代码中辨认
+const apiKeySecretPrefix = "sk-ullm-"
+
+// runKeysCommand 处理 `ullm keys <create|list|revoke|rotate>`
+func runKeysCommand(args []string) error {
+	if len(args) == 0 {
+		keysHelp()
+		return errors.New("缺少子命令")
+	}
+
+	switch args[0] {
+	case "create":
+		return keysCreate(args[1:])
+	case "list":
+		return keysList(args[1:])
+	case "revoke":
+		return keysRevoke(args[1:])
+	case "rotate":
+		return keysRotate(args[1:])
+	default:
+		keysHelp()
+		return fmt.Errorf("未知的子命令 %q", args[0])
+	}
+}
+
+func keysHelp() {
+	fmt.Printf("使用方法: ullm keys <create|list|revoke|rotate> [arguments]\n")
+	fmt.Printf("  create --name NAME [--models M1,M2] [--expires 30d] [--label K=V]... [--rpm N] [--tpm N] [--daily-tokens N] [--monthly-tokens N] [--max-streams N]\n")
+	fmt.Printf("                    创建key并打印密钥（只显示这一次）\n")
+	fmt.Printf("  list              列出所有key\n")
+	fmt.Printf("  revoke [--config FILE] ID   停用key\n")
+	fmt.Printf("  rotate [--config FILE] ID   为key生成新密钥，旧密钥立即失效\n")
+	fmt.Printf("所有子命令都接受 --config FILE（须写在ID之前），从配置文件的 auth.keys_file / state_dir 确定密钥文件位置\n")
+}
+
+// 打开 --config 指定的配置，返回密钥文件路径
+func keysFileFromFlags(fs *flag.FlagSet, configPath *string, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return "", err
+	}
+	return keysFilePath(cfg.Auth, cfg.StateDir), nil
+}
+
+// 可重复的 --label K=V 参数
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelFlags) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("标签格式应为 KEY=VALUE: %q", value)
+	}
+	l[k] = v
+	return nil
+}
+
+func keysCreate(args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON配置文件路径")
+	name := fs.String("name", "", "key的名称")
+	models := fs.String("models", "", "允许使用的模型，逗号分隔，为空表示不限制")
+	expires := fs.String("expires", "", "过期时间：时长（如 720h、30d）或日期（如 2026-12-31）")
+	labels := labelFlags{}
+	fs.Var(labels, "label", "标签 KEY=VALUE，可重复")
+	var limits KeyLimits
+	fs.IntVar(&limits.RPM, "rpm", 0, "每分钟请求数上限")
+	fs.IntVar(&limits.TPM, "tpm", 0, "每分钟token数上限")
+	fs.IntVar(&limits.DailyTokens, "daily-tokens", 0, "每天token额度")
+	fs.IntVar(&limits.MonthlyTokens, "monthly-tokens", 0, "每月token额度")
+	fs.IntVar(&limits.Streams, "max-streams", 0, "同时打开的流式连接数上限")
+
+	path, err := keysFileFromFlags(fs, configPath, args)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("--name 不能为空")
+	}
+	allowed, err := parseModelList(*models)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expiresAt, err := parseExpiry(*expires, now)
+	if err != nil {
+		return err
+	}
+	if limits.RPM < 0 || limits.TPM < 0 || limits.DailyTokens < 0 || limits.MonthlyTokens < 0 || limits.Streams < 0 {
+		return errors.New("限制不能为负数")
+	}
+
+	file, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		return err
+	}
+	key := &APIKey{
+		ID:            "key_" + randomHex(8),
+		Name:          *name,
+		Hash:          hashAPIKey(secret),
+		Prefix:        secret[:len(apiKeySecretPrefix)+4],
+		Enabled:       true,
+		CreatedAt:     now.UTC(),
+		ExpiresAt:     expiresAt,
+		AllowedModels: allowed,
+		Limits:        limits,
+	}
+	if len(labels) > 0 {
+		key.Labels = labels
+	}
+	file.Keys = append(file.Keys, key)
+	if err := writeKeyFile(path, file); err != nil {
+		return fmt.Errorf("写入密钥文件失败: %v", err)
+	}
+
+	fmt.Printf("已创建 %s (%s)\n", key.ID, key.Name)
+	fmt.Printf("密钥（只显示这一次，请妥善保存）:\n%s\n", secret)
+	return nil
+}
+
+func keysList(args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON配置文件路径")
+	path, err := keysFileFromFlags(fs, configPath, args)
+	if err != nil {
+		return err
+	}
+	file, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	if len(file.Keys) == 0 {
+		fmt.Printf("%s 中没有key\n", path)
+		return nil
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSTATUS\tEXPIRES\tMODELS\tLIMITS\tLABELS")
+	for _, key := range file.Keys {
+		status := "active"
+		switch {
+		case !key.Enabled:
+			status = "revoked"
+		case key.Expired(now):
+			status = "expired"
+		}
+		expires := "-"
+		if !key.ExpiresAt.IsZero() {
+			expires = key.ExpiresAt.Local().Format("2006-01-02 15:04")
+		}
+		models := "*"
+		if len(key.AllowedModels) > 0 {
+			models = strings.Join(key.AllowedModels, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s...\t%s\t%s\t%s\t%s\t%s\n",
+			key.ID, key.Name, key.Prefix, status, expires, models, formatLimits(key.Limits), formatLabels(key.Labels))
+	}
+	return tw.Flush()
+}
+
+func keysRevoke(args []string) error {
+	fs := flag.NewFlagSet("keys revoke", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON配置文件路径")
+	path, err := keysFileFromFlags(fs, configPath, args)
+	if err != nil {
+		return err
+	}
+	return updateKey(path, fs.Args(), func(key *APIKey) error {
+		key.Enabled = false
+		fmt.Printf("已停用 %s (%s)\n", key.ID, key.Name)
+		return nil
+	})
+}
+
+func keysRotate(args []string) error {
+	fs := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON配置文件路径")
+	path, err := keysFileFromFlags(fs, configPath, args)
+	if err != nil {
+		return err
+	}
+	return updateKey(path, fs.Args(), func(key *APIKey) error {
+		secret, err := newAPIKeySecret()
+		if err != nil {
+			return err
+		}
+		// ID和其余设置不变，旧密钥的哈希被替换后立即失效
+		key.Hash = hashAPIKey(secret)
+		key.Prefix = secret[:len(apiKeySecretPrefix)+4]
+		fmt.Printf("已为 %s (%s) 生成新密钥，旧密钥已失效\n", key.ID, key.Name)
+		fmt.Printf("新密钥（只显示这一次，请妥善保存）:\n%s\n", secret)
+		return nil
+	})
+}
+
+// 按ID修改一个key并写回文件
+func updateKey(path string, args []string, update func(key *APIKey) error) error {
+	if len(args) != 1 {
+		return errors.New("需要指定一个key ID")
+	}
+	file, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(file.Keys, func(k *APIKey) bool { return k.ID == args[0] })
+	if i < 0 {
+		return fmt.Errorf("%s 中没有 %s", path, args[0])
+	}
+	if err := update(file.Keys[i]); err != nil {
+		return err
+	}
+	if err := writeKeyFile(path, file); err != nil {
+		return fmt.Errorf("写入密钥文件失败: %v", err)
+	}
+	return nil
+}
+
+// 生成新的随机密钥
+func newAPIKeySecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeySecretPrefix + hex.EncodeToString(b), nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 解析逗号分隔的模型列表，拒绝未知模型以免拼写错误导致key无法使用
+func parseModelList(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var models []string
+	for _, model := range strings.Split(s, ",") {
+		model = strings.TrimSpace(model)
+		if model == "" {
+			continue
+		}
+		if !slices.ContainsFunc(ModelConfigs, func(c ModelConfig) bool { return c.ID == model }) {
+			return nil, fmt.Errorf("未知的模型 %q", model)
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// 解析过期时间：日期、RFC3339时间、Go时长或以d结尾的天数
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n > 0 {
+			return now.AddDate(0, 0, n).UTC(), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("无法解析过期时间 %q", s)
+}
+
+func formatLimits(l KeyLimits) string {
+	var parts []string
+	if l.RPM > 0 {
+		parts = append(parts, fmt.Sprintf("rpm=%d", l.RPM))
+	}
+	if l.TPM > 0 {
+		parts = append(parts, fmt.Sprintf("tpm=%d", l.TPM))
+	}
+	if l.DailyTokens > 0 {
+		parts = append(parts, fmt.Sprintf("daily=%d", l.DailyTokens))
+	}
+	if l.MonthlyTokens > 0 {
+		parts = append(parts, fmt.Sprintf("monthly=%d", l.MonthlyTokens))
+	}
+	if l.Streams > 0 {
+		parts = append(parts, fmt.Sprintf("streams=%d", l.Streams))
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(labels))
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
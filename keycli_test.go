@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseModelList(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "  ", want: nil},
+		{in: "qwen", want: []string{"qwen"}},
+		{in: " qwen , doubao ", want: []string{"qwen", "doubao"}},
+		{in: "qwen,,deepseek-v3.1,", want: []string{"qwen", "deepseek-v3.1"}},
+		{in: "qwen,gpt-4", wantErr: true},
+		{in: "Qwen", wantErr: true}, // 区分大小写
+	} {
+		got, err := parseModelList(tc.in)
+		if (err != nil) != tc.wantErr || !slices.Equal(got, tc.want) {
+			t.Errorf("parseModelList(%q) = (%v, %v), want (%v, err=%v)", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Time{}}, // 不过期
+		{in: "30d", want: now.AddDate(0, 0, 30)},
+		{in: "1d", want: now.Add(24 * time.Hour)},
+		{in: "12h", want: now.Add(12 * time.Hour)},
+		{in: "90m", want: now.Add(90 * time.Minute)},
+		{in: "2025-04-01", want: time.Date(2025, 4, 1, 0, 0, 0, 0, time.Local).UTC()},
+		{in: "2025-04-01T08:30:00+08:00", want: time.Date(2025, 4, 1, 0, 30, 0, 0, time.UTC)},
+		{in: "0d", wantErr: true},
+		{in: "-5d", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "0s", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "tomorrow", wantErr: true},
+		{in: "2025-13-01", wantErr: true},
+		{in: "2025/04/01", wantErr: true},
+	} {
+		got, err := parseExpiry(tc.in, now)
+		if (err != nil) != tc.wantErr || !got.Equal(tc.want) {
+			t.Errorf("parseExpiry(%q) = (%v, %v), want (%v, err=%v)", tc.in, got, err, tc.want, tc.wantErr)
+		}
+		if err == nil && !got.IsZero() && got.Location() != time.UTC {
+			t.Errorf("parseExpiry(%q) = %v, want UTC", tc.in, got)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey 一个客户端API key。文件中只保存密钥的SHA-256，明文只在创建时显示一次
+type APIKey struct {
+	ID            string            `json:"id"`                       // 稳定的key标识，用作上游sessionId、日志和续传流的归属
+	Name          string            `json:"name"`                     // 便于识别的名称
+	Hash          string            `json:"hash"`                     // 密钥的SHA-256（十六进制）
+	Prefix        string            `json:"prefix"`                   // 密钥开头几位，用于在列表中辨认
+	Enabled       bool              `json:"enabled"`                  // 停用的key会被拒绝
+	CreatedAt     time.Time         `json:"created_at"`               // 创建时间
+	ExpiresAt     time.Time         `json:"expires_at,omitzero"`      // 过期时间，零值表示不过期
+	AllowedModels []string          `json:"allowed_models,omitempty"` // 允许请求的模型，为空表示不限制
+	Labels        map[string]string `json:"labels,omitempty"`         // 自定义标签，如团队、用途
+	Limits        KeyLimits         `json:"limits,omitzero"`          // 用量限制，0表示不限制
+}
+
+// KeyLimits 单个key的用量限制
+type KeyLimits struct {
+	RPM           int `json:"rpm,omitempty"`            // 每分钟请求数
+	TPM           int `json:"tpm,omitempty"`            // 每分钟token数
+	DailyTokens   int `json:"daily_tokens,omitempty"`   // 每天token额度
+	MonthlyTokens int `json:"monthly_tokens,omitempty"` // 每月token额度
+	Streams       int `json:"streams,omitempty"`        // 同时打开的流式连接数
+}
+
+// Expired 判断key是否已过期
+func (k *APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// AllowsModel 判断该key是否可以请求指定模型
+func (k *APIKey) AllowsModel(model string) bool {
+	return len(k.AllowedModels) == 0 || slices.Contains(k.AllowedModels, model)
+}
+
+// keyFile keys.json 的文件格式
+type keyFile struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+// 密钥文件最多每隔这么久检查一次是否被修改
+const keyStoreReloadInterval = time.Second
+
+// KeyStore 以文件保存的客户端API key。文件被 `ullm keys` 修改后自动重新加载，无需重启服务
+type KeyStore struct {
+	mu        sync.Mutex
+	path      string
+	byHash    map[string]*APIKey
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// 全局客户端key存储，startServer 按配置初始化；为nil时不校验key
+var keyStore *KeyStore
+
+// newKeyStore 打开密钥文件，文件不存在时视为没有任何key
+func newKeyStore(cfg AuthConfig, stateDir string) (*KeyStore, error) {
+	s := &KeyStore{path: keysFilePath(cfg, stateDir), byHash: map[string]*APIKey{}}
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// keysFilePath 返回密钥文件路径，默认为状态目录下的 keys.json
+func keysFilePath(cfg AuthConfig, stateDir string) string {
+	if cfg.KeysFile != "" {
+		return cfg.KeysFile
+	}
+	return filepath.Join(stateDir, "keys.json")
+}
+
+// readKeyFile 读取密钥文件，文件不存在时返回空列表
+func readKeyFile(path string) (*keyFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &keyFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("解析密钥文件 %s 失败: %v", path, err)
+	}
+	return &file, nil
+}
+
+// writeKeyFile 原子地写入密钥文件，仅所有者可读写
+func writeKeyFile(path string, file *keyFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+// hashAPIKey 返回密钥的SHA-256。密钥是随机生成的长字符串，不需要加盐的慢哈希
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Len 返回已登记的key数量
+func (s *KeyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byHash)
+}
+
+// Lookup 根据客户端提供的密钥查找key，不检查是否可用
+func (s *KeyStore) Lookup(secret string) (*APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.checkedAt) >= keyStoreReloadInterval {
+		if err := s.reloadLocked(); err != nil {
+			// 文件暂时不可读或格式错误时继续使用上次加载的key
+			slog.Warn("重新加载密钥文件失败", "path", s.path, "err", err)
+		}
+	}
+	key, ok := s.byHash[hashAPIKey(secret)]
+	return key, ok
+}
+
+// 文件修改时间变化时重新读取
+func (s *KeyStore) reloadLocked() error {
+	s.checkedAt = time.Now()
+
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.byHash = map[string]*APIKey{}
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	file, err := readKeyFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	byHash := make(map[string]*APIKey, len(file.Keys))
+	for _, key := range file.Keys {
+		byHash[key.Hash] = key
+	}
+	s.byHash = byHash
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// OpenAI风格的错误响应
+type openAIError struct {
+	Error openAIErrorBody `json:"error"`
+}
+
+type openAIErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// writeOpenAIError 以OpenAI的错误格式返回，客户端SDK可以直接解析出错误信息
+func writeOpenAIError(w http.ResponseWriter, status int, message, errType, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(openAIError{Error: openAIErrorBody{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}})
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext 返回 apiKeyMiddleware 认证通过的key
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// 在错误信息中只显示密钥首尾几位
+func maskAPIKey(secret string) string {
+	if len(secret) <= 8 {
+		return "***"
+	}
+	return secret[:3] + "..." + secret[len(secret)-4:]
+}
+
+// apiKeyMiddleware 校验 Authorization 头中的客户端key，并把对应的 APIKey 放入请求context
+func apiKeyMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		secret := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		if secret == "" {
+			auditAuthRejection(r, nil, http.StatusUnauthorized, "missing API key")
+			writeOpenAIError(w, http.StatusUnauthorized,
+				"You didn't provide an API key. Provide it in the Authorization header as 'Bearer YOUR_KEY'.",
+				"invalid_request_error", "missing_api_key")
+			return
+		}
+
+		var key *APIKey
+		if keyStore == nil {
+			// 未启用密钥校验：接受任意key，用其哈希作为标识，避免把原始key发给上游
+			key = &APIKey{ID: "anon_" + hashAPIKey(secret)[:16], Name: "anonymous", Enabled: true}
+		} else {
+			found, ok := keyStore.Lookup(secret)
+			switch {
+			case !ok:
+				slog.WarnContext(r.Context(), "rejected unknown API key", "api_key_masked", maskAPIKey(secret), "remote_addr", r.RemoteAddr)
+				auditAuthRejection(r, nil, http.StatusUnauthorized, "unknown API key "+maskAPIKey(secret))
+				writeOpenAIError(w, http.StatusUnauthorized,
+					fmt.Sprintf("Incorrect API key provided: %s.", maskAPIKey(secret)),
+					"invalid_request_error", "invalid_api_key")
+				return
+			case !found.Enabled:
+				slog.WarnContext(r.Context(), "rejected disabled API key", "key", found.ID)
+				auditAuthRejection(r, found, http.StatusUnauthorized, "API key disabled")
+				writeOpenAIError(w, http.StatusUnauthorized, "This API key has been disabled.",
+					"invalid_request_error", "invalid_api_key")
+				return
+			case found.Expired(time.Now()):
+				slog.WarnContext(r.Context(), "rejected expired API key", "key", found.ID)
+				auditAuthRejection(r, found, http.StatusUnauthorized, "API key expired")
+				writeOpenAIError(w, http.StatusUnauthorized, "This API key has expired.",
+					"invalid_request_error", "invalid_api_key")
+				return
+			}
+			key = found
+		}
+
+		// 所有认证通过的响应都带上当前限额状态（不消耗额度），
+		// 包括被后续检查提前拒绝的请求和 /v1/models；serveAPI 限流后会用扣除后的状态覆盖
+		rateLimiter.Status(key, "").WriteHeaders(w.Header())
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
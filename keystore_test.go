@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useKeyStore 在测试期间启用只包含给定key的密钥文件，keys中的Hash按map的键（明文密钥）计算
+func useKeyStore(t *testing.T, keys map[string]*APIKey) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	file := &keyFile{}
+	for secret, key := range keys {
+		key.Hash = hashAPIKey(secret)
+		file.Keys = append(file.Keys, key)
+	}
+	if err := writeKeyFile(path, file); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newKeyStore(AuthConfig{KeysFile: path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := keyStore
+	keyStore = store
+	t.Cleanup(func() { keyStore = saved })
+}
+
+// 调用 apiKeyMiddleware，返回响应以及交给处理函数的key（被拒绝时为nil）
+func authenticate(t *testing.T, secret string) (*httptest.ResponseRecorder, *APIKey) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader("{}"))
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	rec := httptest.NewRecorder()
+	var got *APIKey
+	apiKeyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		got = apiKeyFromContext(r.Context())
+	})(rec, req)
+	return rec, got
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	records := useAuditLog(t, "omit")
+	useKeyStore(t, map[string]*APIKey{
+		"sk-good-0123456789":     {ID: "good", Enabled: true},
+		"sk-disabled-0123456789": {ID: "disabled"},
+		"sk-expired-0123456789":  {ID: "expired", Enabled: true, ExpiresAt: time.Now().Add(-time.Hour)},
+		"sk-later-0123456789":    {ID: "later", Enabled: true, ExpiresAt: time.Now().Add(time.Hour)},
+	})
+
+	for _, tc := range []struct {
+		secret      string
+		wantKey     string
+		wantCode    string
+		wantAuditID string
+		wantReason  string
+	}{
+		{secret: "sk-good-0123456789", wantKey: "good"},
+		{secret: "sk-later-0123456789", wantKey: "later"},
+		{secret: "", wantCode: "missing_api_key", wantReason: "missing API key"},
+		{secret: "sk-unknown-0123456789", wantCode: "invalid_api_key", wantReason: "unknown API key sk-...6789"},
+		{secret: "sk-disabled-0123456789", wantCode: "invalid_api_key", wantAuditID: "disabled", wantReason: "API key disabled"},
+		{secret: "sk-expired-0123456789", wantCode: "invalid_api_key", wantAuditID: "expired", wantReason: "API key expired"},
+	} {
+		before := len(records())
+		rec, key := authenticate(t, tc.secret)
+
+		if tc.wantCode == "" {
+			if key == nil || key.ID != tc.wantKey || rec.Code != http.StatusOK {
+				t.Errorf("%q: status %d, key %+v, want %s", tc.secret, rec.Code, key, tc.wantKey)
+			}
+			if got := len(records()); got != before {
+				t.Errorf("%q: accepted request wrote %d audit lines", tc.secret, got-before)
+			}
+			continue
+		}
+
+		var body openAIError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%q: %v in %q", tc.secret, err, rec.Body.String())
+		}
+		if key != nil || rec.Code != http.StatusUnauthorized || body.Error.Code != tc.wantCode || body.Error.Type != "invalid_request_error" {
+			t.Errorf("%q: status %d, error %+v, handler called with %+v", tc.secret, rec.Code, body.Error, key)
+		}
+		got := records()
+		if len(got) != before+1 {
+			t.Fatalf("%q: %d audit lines, want 1", tc.secret, len(got)-before)
+		}
+		if r := got[len(got)-1]; r.Status != http.StatusUnauthorized || r.KeyID != tc.wantAuditID || r.Error != tc.wantReason {
+			t.Errorf("%q: audit record = %+v", tc.secret, r)
+		}
+	}
+}
+
+// 未启用密钥校验时接受任意key，以密钥的哈希作为标识，不暴露原始key
+func TestAPIKeyMiddlewareAnonymous(t *testing.T) {
+	saved := keyStore
+	keyStore = nil
+	t.Cleanup(func() { keyStore = saved })
+
+	rec, a := authenticate(t, "sk-anything")
+	_, again := authenticate(t, "sk-anything")
+	_, other := authenticate(t, "sk-other")
+	if rec.Code != http.StatusOK || a == nil || a.Name != "anonymous" || !a.Enabled {
+		t.Fatalf("status %d, key %+v", rec.Code, a)
+	}
+	if a.ID != "anon_"+hashAPIKey("sk-anything")[:16] || strings.Contains(a.ID, "sk-anything") {
+		t.Fatalf("anonymous key ID = %q", a.ID)
+	}
+	if again.ID != a.ID || other.ID == a.ID {
+		t.Fatalf("IDs not stable per secret: %q, %q, %q", a.ID, again.ID, other.ID)
+	}
+
+	if rec, key := authenticate(t, ""); rec.Code != http.StatusUnauthorized || key != nil {
+		t.Fatalf("missing key in anonymous mode: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// 替换敏感内容的占位符
+const redacted = "[REDACTED]"
+
+// 字段名最后一段为这些词时整个值被替换，如 token、upstream_token、admin_password
+var sensitiveKeyWords = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"passwd":        true,
+	"secret":        true,
+	"authorization": true,
+	"cookie":        true,
+	"apikey":        true,
+}
+
+// 日志文本中出现的密钥、令牌
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization: Bearer xxx
+	{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`), "Bearer " + redacted},
+	// 客户端密钥，如 sk-ullm-...
+	{regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{8,}`), "sk-" + redacted},
+	// JWT
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), redacted},
+	// token=xxx、"password": "xxx" 等键值对；值以 Bearer 开头时保留前缀
+	{regexp.MustCompile(`(?i)("?\b(?:[a-z_]*token|password|passwd|secret|api_?key|authorization)"?\s*[:=]\s*"?(?:bearer\s+)?)[^"\s,&}]+`), "${1}" + redacted},
+}
+
+// redactString 替换文本中的密钥和令牌
+func redactString(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// 判断字段名是否表示敏感内容
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "api_key") {
+		return true
+	}
+	if i := strings.LastIndexAny(key, "_-."); i >= 0 {
+		key = key[i+1:]
+	}
+	return sensitiveKeyWords[key]
+}
+
+// redactAttr 作为 slog 的 ReplaceAttr：敏感字段整体替换，其余字符串和错误中的密钥单独替换
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.TimeKey && a.Key != slog.LevelKey && isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, redactString(v.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, redactString(v.String()))
+		}
+	}
+	return a
+}
+
+// redactHeaders 返回可以写入日志的请求头，认证相关的头被替换
+func redactHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string, len(h))
+	for name, values := range h {
+		value := strings.Join(values, ", ")
+		if isSensitiveKey(name) || strings.EqualFold(name, "X-Api-Key") {
+			value = redacted
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// setupLogging 按配置安装全局 slog 日志，--debug 时级别为 debug。
+// 标准库 log 的输出也经过同一个handler
+func setupLogging(cfg LogConfig, debug bool) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("无效的日志级别 %q", cfg.Level)
+	}
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("无效的日志格式 %q，应为 text 或 json", cfg.Format)
+	}
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}))
+	return nil
+}
+
+// contextHandler 为使用 *Context 方法记录的日志补上请求ID，已有 request_id 字段时不重复添加
+type contextHandler struct {
+	slog.Handler
+	hasRequestID bool // With 已带有 request_id
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.hasRequestID {
+		return h.Handler.Handle(ctx, r)
+	}
+	id := requestIDFromContext(ctx)
+	if id == "" {
+		return h.Handler.Handle(ctx, r)
+	}
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		found = a.Key == "request_id"
+		return !found
+	})
+	if !found {
+		r = r.Clone()
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	has := h.hasRequestID
+	for _, a := range attrs {
+		has = has || a.Key == "request_id"
+	}
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs), hasRequestID: has}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name), hasRequestID: h.hasRequestID}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"log/slog"
 	"os"
 )
 
@@ -13,6 +14,7 @@ func main() {
 	// 定义serve命令的端口参数
 	port := serveCmd.Int("port", 8080, "服务器端口号")
 	debug := serveCmd.Bool("debug", false, "启用调试模式，打印详细的客户端请求日志")
+	configPath := serveCmd.String("config", "", "JSON配置文件路径")
 
 	if len(os.Args) < 2 {
 		help()
@@ -22,8 +24,18 @@ func main() {
 	switch os.Args[1] {
 	case "serve":
 		serveCmd.Parse(os.Args[2:])
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("加载配置失败: %v", err)
+		}
+		config = cfg
 		if err := startServer(*port, *debug); err != nil {
-			log.Fatalf("服务器启动失败: %v", err)
+			slog.Error("服务器启动失败", "err", err)
+			os.Exit(1)
+		}
+	case "keys":
+		if err := runKeysCommand(os.Args[2:]); err != nil {
+			log.Fatalf("keys: %v", err)
 		}
 	default:
 		help()
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 以Prometheus文本格式输出的指标，不依赖客户端库
+
+// metricWriter 一组同名指标
+type metricWriter interface {
+	writeMetric(w *bufio.Writer)
+}
+
+// 已注册的指标，按注册顺序输出
+var metricRegistry []metricWriter
+
+func registerMetric[M metricWriter](m M) M {
+	metricRegistry = append(metricRegistry, m)
+	return m
+}
+
+var (
+	requestsTotal = registerMetric(newMetricVec("ullm_requests_total", "counter",
+		"API requests by endpoint, model and HTTP status.", "endpoint", "model", "status"))
+	requestsInFlight = registerMetric(newMetricVec("ullm_requests_in_flight", "gauge",
+		"API requests currently being served.", "endpoint"))
+	requestDuration = registerMetric(newHistogramVec("ullm_request_duration_seconds",
+		"Time to serve non-streaming API requests.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "endpoint"))
+	streamDuration = registerMetric(newHistogramVec("ullm_stream_duration_seconds",
+		"How long streaming responses stay open.",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600}, "endpoint"))
+	upstreamLatency = registerMetric(newHistogramVec("ullm_upstream_latency_seconds",
+		"Time from calling the upstream until its answer is complete.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "model"))
+	timeToFirstToken = registerMetric(newHistogramVec("ullm_time_to_first_token_seconds",
+		"Time from calling the upstream until the first answer text arrives.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60}, "model"))
+	upstreamQueueWait = registerMetric(newHistogramVec("ullm_upstream_queue_wait_seconds",
+		"Time spent waiting for an upstream concurrency slot.",
+		[]float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60}))
+	tokensTotal = registerMetric(newMetricVec("ullm_tokens_total", "counter",
+		"Locally estimated tokens by model and type (prompt or completion).", "model", "type"))
+	_ = registerMetric(&gaugeFunc{"ullm_active_streams", "Open streaming connections across all keys.", func() float64 {
+		total := 0
+		for _, ks := range streamTracker.Snapshot() {
+			total += ks.Active
+		}
+		return float64(total)
+	}})
+	_ = registerMetric(&gaugeFunc{"go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	}})
+)
+
+// metricModel 返回用作标签的模型名，未知模型归为 other，避免客户端任意填写导致标签过多
+func metricModel(model string) string {
+	if model == "" {
+		return "none"
+	}
+	if slices.ContainsFunc(ModelConfigs, func(c ModelConfig) bool { return c.ID == model }) {
+		return model
+	}
+	return "other"
+}
+
+// metricVec 带标签的计数器或仪表
+type metricVec struct {
+	name, kind, help string
+	labels           []string
+	mu               sync.Mutex
+	values           map[string]float64 // 以 labelKey 编码的标签值为键
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, kind: kind, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// 把标签值拼成map键，\xff 不会出现在正常的标签值中
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (m *metricVec) Add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelKey(labelValues)] += delta
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) writeMetric(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(w, m.name, m.kind, m.help)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, metricLabels(m.labels, key), formatMetricValue(m.values[key]))
+	}
+}
+
+// histogramVec 带标签的直方图
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // 各桶上界，升序
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 落在每个桶（不累计）的次数，最后一个为 +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(d time.Duration, labelValues ...string) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := labelKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v) // 第一个 >= v 的上界
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeMetric(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, "histogram", h.help)
+	bucketLabels := append(slices.Clone(h.labels), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatMetricValue(h.buckets[i])
+			}
+			bucketKey := le
+			if len(h.labels) > 0 {
+				bucketKey = labelKey([]string{key, le})
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricLabels(bucketLabels, bucketKey), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, metricLabels(h.labels, key), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, metricLabels(h.labels, key), s.count)
+	}
+}
+
+// gaugeFunc 输出时才取值的仪表
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *gaugeFunc) writeMetric(w *bufio.Writer) {
+	writeMetricHeader(w, g.name, "gauge", g.help)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(g.value()))
+}
+
+// /debug/vars 中不转换为指标的变量
+var expvarSkip = map[string]bool{"cmdline": true, "memstats": true}
+
+// expvar map 转换为指标时使用的标签名，默认为 key
+var expvarMapLabels = map[string]string{"upstream_phase_ms_total": "phase"}
+
+// writeExpvarMetrics 把 /debug/vars 中的计数转换为 ullm_ 开头的指标：
+// Int 为计数器，Map 为带标签的计数器，返回数字的 Func 为仪表
+func writeExpvarMetrics(w *bufio.Writer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		if expvarSkip[kv.Key] {
+			return
+		}
+		name := "ullm_" + kv.Key
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			if !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+			writeMetricHeader(w, name, "counter", "Counter "+kv.Key+" from /debug/vars.")
+			fmt.Fprintf(w, "%s %d\n", name, v.Value())
+		case *expvar.Map:
+			label := expvarMapLabels[kv.Key]
+			if label == "" {
+				label = "key"
+			}
+			writeMetricHeader(w, name, "counter", "Counter "+kv.Key+" from /debug/vars.")
+			v.Do(func(entry expvar.KeyValue) {
+				if n, ok := entry.Value.(*expvar.Int); ok {
+					fmt.Fprintf(w, "%s%s %d\n", name, metricLabels([]string{label}, entry.Key), n.Value())
+				}
+			})
+		case expvar.Func:
+			var value float64
+			switch n := v.Value().(type) {
+			case int:
+				value = float64(n)
+			case int64:
+				value = float64(n)
+			case float64:
+				value = n
+			default:
+				return
+			}
+			writeMetricHeader(w, name, "gauge", "Gauge "+kv.Key+" from /debug/vars.")
+			fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+		}
+	})
+}
+
+func writeMetricHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metricLabels 把 labelKey 编码的标签值格式化为 {a="1",b="2"}
+func metricLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 以Prometheus文本格式输出所有指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metricRegistry {
+		m.writeMetric(bw)
+	}
+	writeExpvarMetrics(bw)
+	bw.Flush()
+}
+
+// statusRecorder 记录响应状态码，保留 Flush 以支持流式响应
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status 返回已写出的状态码；什么都没写时为客户端已断开，记为499
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return 499
+	}
+	return r.status
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 一行样本：名称、可选的标签和值
+var metricSampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? (\S+)$`)
+
+type metricSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseMetricLabels 按Prometheus文本格式解析 a="1",b="2"，还原转义
+func parseMetricLabels(t *testing.T, s string) map[string]string {
+	t.Helper()
+	labels := map[string]string{}
+	for s != "" {
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok {
+			t.Fatalf("malformed labels %q", s)
+		}
+		var value strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] != '\\' {
+				value.WriteByte(rest[i])
+				continue
+			}
+			i++
+			switch rest[i] {
+			case '\\', '"':
+				value.WriteByte(rest[i])
+			case 'n':
+				value.WriteByte('\n')
+			default:
+				t.Fatalf("invalid escape \\%c in %q", rest[i], s)
+			}
+		}
+		if i == len(rest) {
+			t.Fatalf("unterminated label value in %q", s)
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(rest[i+1:], ",")
+	}
+	return labels
+}
+
+// scrapeMetrics 请求 /metrics 并解析输出，检查每个样本之前都有同一指标的 HELP 和 TYPE
+func scrapeMetrics(t *testing.T) (map[string]string, []metricSample) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	types := map[string]string{}
+	helped := map[string]bool{}
+	var samples []metricSample
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "# HELP "); ok {
+			name, help, _ := strings.Cut(name, " ")
+			if help == "" || helped[name] {
+				t.Fatalf("missing or duplicate HELP: %q", line)
+			}
+			helped[name] = true
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, kind, _ := strings.Cut(rest, " ")
+			if !helped[name] || types[name] != "" {
+				t.Fatalf("TYPE without HELP or duplicate TYPE: %q", line)
+			}
+			switch kind {
+			case "counter", "gauge", "histogram":
+			default:
+				t.Fatalf("unknown type in %q", line)
+			}
+			types[name] = kind
+			continue
+		}
+
+		m := metricSampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed sample line %q", line)
+		}
+		family := m[1]
+		if types[family] == "" {
+			family = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(family, "_bucket"), "_sum"), "_count")
+			if types[family] != "histogram" {
+				t.Fatalf("sample before its TYPE: %q", line)
+			}
+		}
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("bad value in %q: %v", line, err)
+		}
+		samples = append(samples, metricSample{name: m[1], labels: parseMetricLabels(t, m[2]), value: value})
+	}
+	return types, samples
+}
+
+func findSamples(samples []metricSample, name string) []metricSample {
+	var found []metricSample
+	for _, s := range samples {
+		if s.name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func TestMetricsOutput(t *testing.T) {
+	saved := metricRegistry
+	t.Cleanup(func() { metricRegistry = saved })
+	counter := registerMetric(newMetricVec("ullm_test_events_total", "counter", "Test events.", "name"))
+	hist := registerMetric(newHistogramVec("ullm_test_latency_seconds", "Test latency.", []float64{0.1, 1}, "model"))
+
+	tricky := "a \"quoted\" back\\slash\nnewline"
+	counter.Add(2, tricky)
+	counter.Inc("plain")
+	for _, d := range []time.Duration{50 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second, 3 * time.Second} {
+		hist.Observe(d, "qwen")
+	}
+
+	types, samples := scrapeMetrics(t)
+	if types["ullm_test_events_total"] != "counter" || types["ullm_test_latency_seconds"] != "histogram" || types["ullm_token_refreshes_total"] != "counter" {
+		t.Fatalf("types = %v", types)
+	}
+
+	values := map[string]float64{}
+	for _, s := range findSamples(samples, "ullm_test_events_total") {
+		values[s.labels["name"]] = s.value
+	}
+	if values[tricky] != 2 || values["plain"] != 1 || len(values) != 2 {
+		t.Fatalf("counter samples = %v", values)
+	}
+
+	buckets := map[string]float64{}
+	for _, s := range findSamples(samples, "ullm_test_latency_seconds_bucket") {
+		if s.labels["model"] != "qwen" {
+			t.Fatalf("bucket labels = %v", s.labels)
+		}
+		buckets[s.labels["le"]] = s.value
+	}
+	// 桶计数是累计的，+Inf 桶等于总次数
+	if buckets["0.1"] != 1 || buckets["1"] != 2 || buckets["+Inf"] != 4 || len(buckets) != 3 {
+		t.Fatalf("buckets = %v", buckets)
+	}
+	sum := findSamples(samples, "ullm_test_latency_seconds_sum")
+	count := findSamples(samples, "ullm_test_latency_seconds_count")
+	if len(sum) != 1 || sum[0].value != 5.55 || sum[0].labels["model"] != "qwen" {
+		t.Fatalf("sum = %+v", sum)
+	}
+	if len(count) != 1 || count[0].value != 4 {
+		t.Fatalf("count = %+v", count)
+	}
+}
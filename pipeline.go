@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 所有OpenAI兼容接口共用同一条处理管线：
+// 解析 → 规范化请求 → 中间件 → 调用上游 → 规范化增量流 → 按接口格式编码。
+// 各接口只负责把自己的请求体解析为 CanonicalRequest，并把结果编码为自己的响应格式
+
+// CanonicalRequest 与具体接口格式无关的请求
+type CanonicalRequest struct {
+	RequestID    string   `json:"request_id"`
+	API          string   `json:"api"` // 接口名，如 "chat.completions"
+	Model        string   `json:"model"`
+	Prompt       string   `json:"prompt"`
+	KeyID        string   `json:"key_id"`   // 客户端API key的ID，用作上游sessionId和续传流的归属
+	Priority     string   `json:"priority"` // 排队等待上游时的优先级：high、normal或low
+	Stream       bool     `json:"stream"`
+	IncludeUsage bool     `json:"include_usage"` // 流式响应最后是否附带用量
+	MaxTokens    *int     `json:"max_tokens,omitempty"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+	Stop         []string `json:"stop,omitempty"`
+	// key允许请求的模型，为空表示不限制；备用模型同样受限
+	AllowedModels []string `json:"-"`
+}
+
+// CanonicalResponse 一次请求的结果。生成过程中ID、Created和ResolvedModel已确定，
+// Text、FinishReason和Usage在生成结束后填充
+type CanonicalResponse struct {
+	ID            string `json:"id"`
+	Created       int64  `json:"created"`
+	Model         string `json:"model"`          // 客户端请求的模型
+	ResolvedModel string `json:"resolved_model"` // 实际回答的模型（可能是备用模型）
+	Text          string `json:"text"`
+	FinishReason  string `json:"finish_reason"` // "stop" 或 "length"
+	Usage         Usage  `json:"usage"`
+}
+
+// upstreamProvider 提供模型回答的上游服务
+type upstreamProvider interface {
+	// Stream 发起请求，返回已确认有内容的增量流和实际回答的模型
+	Stream(ctx context.Context, req *CanonicalRequest) (deltaStream, string, error)
+}
+
+// deltaStream 上游回答的增量文本流，结束时返回io.EOF
+type deltaStream interface {
+	Next() (string, error)
+	Close() error
+}
+
+// kbChatProvider 通过kbChat接口回答，按备用模型链和重试配置请求
+type kbChatProvider struct{}
+
+func (kbChatProvider) Stream(ctx context.Context, req *CanonicalRequest) (deltaStream, string, error) {
+	stream, resolvedModel, err := processChatRequestWithFallback(ctx, ChatProcessParams{
+		Model:         req.Model,
+		Prompt:        req.Prompt,
+		SessionID:     req.KeyID,
+		RequestID:     req.RequestID,
+		AllowedModels: req.AllowedModels,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return stream, resolvedModel, nil
+}
+
+// 全局上游服务
+var provider upstreamProvider = kbChatProvider{}
+
+// 拒绝没有可用prompt的请求
+func validateRequest(req *CanonicalRequest) error {
+	if strings.TrimSpace(req.Prompt) == "" {
+		return errors.New("No valid input found")
+	}
+	if req.MaxTokens != nil && *req.MaxTokens < 1 {
+		return errors.New("max_tokens must be at least 1")
+	}
+	return nil
+}
+
+// apiEndpoint 一个OpenAI兼容接口：请求解析和响应编码
+type apiEndpoint struct {
+	name     string
+	idPrefix string
+	parse    func(body []byte) (*CanonicalRequest, error)
+	encoder  responseEncoder
+}
+
+// responseEncoder 把规范化结果编码为某个接口的响应格式
+type responseEncoder interface {
+	// StreamDelta 返回一段增量文本对应的流式事件
+	StreamDelta(resp *CanonicalResponse, text string) []any
+	// StreamEnd 返回生成结束后的流式事件（结束原因、用量等），之后会发送 [DONE]
+	StreamEnd(req *CanonicalRequest, resp *CanonicalResponse) []any
+	// Response 返回非流式响应体
+	Response(resp *CanonicalResponse) any
+}
+
+// runPipeline 调用上游并把经过停止序列、max_tokens和钩子处理的增量文本交给onDelta。
+// 拿到第一段回答之前失败时返回的结果为nil；生成中途失败时同时返回已生成的部分结果和错误
+func runPipeline(ctx context.Context, req *CanonicalRequest, idPrefix string,
+	onDelta func(resp *CanonicalResponse, text string)) (*CanonicalResponse, error) {
+	// 占用一个上游并发名额直到上游流关闭
+	queued := time.Now()
+	release, err := upstreamLimiter.Acquire(ctx, req.KeyID, req.Priority)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	upstreamQueueWait.Observe(time.Since(queued))
+
+	// upstream.timeout 是整个请求的期限，覆盖所有重试、备用模型和读取回答；到期后不再重试或切换模型
+	if timeout := time.Duration(config.Upstream.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	upstreamStart := time.Now()
+	stream, resolvedModel, err := provider.Stream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	firstToken := false
+
+	now := time.Now()
+	resp := &CanonicalResponse{
+		ID:            idPrefix + "-" + randomHex(12),
+		Created:       now.Unix(),
+		Model:         req.Model,
+		ResolvedModel: resolvedModel,
+		FinishReason:  "stop",
+	}
+
+	var text strings.Builder
+	var emitted tokenCounter // 已输出文本的估算token数，每段只估算新增部分
+	// 输出一段文本，已输出的文本加上这段超出max_tokens时截断并返回true
+	emit := func(delta string) (bool, error) {
+		limited := false
+		if req.MaxTokens != nil {
+			delta, limited = emitted.Truncate(delta, *req.MaxTokens)
+		}
+		delta, err := pipelineHooks.OnDelta(ctx, req, delta)
+		if err != nil {
+			return false, err
+		}
+		if delta != "" {
+			text.WriteString(delta)
+			emitted.Write(delta)
+			if onDelta != nil {
+				onDelta(resp, delta)
+			}
+		}
+		return limited, nil
+	}
+
+	stops := newStopFilter(req.Stop)
+	var streamErr error
+	for {
+		chunk, err := stream.Next()
+		if err != nil {
+			if err != io.EOF {
+				streamErr = err
+				break
+			}
+			limited, err := emit(stops.Flush())
+			if limited {
+				resp.FinishReason = "length"
+			}
+			streamErr = err
+			break
+		}
+
+		if !firstToken && chunk != "" {
+			firstToken = true
+			timeToFirstToken.Observe(time.Since(upstreamStart), metricModel(resolvedModel))
+		}
+
+		safe, stopped := stops.Push(chunk)
+		limited, err := emit(safe)
+		if err != nil {
+			streamErr = err
+			break
+		}
+		if limited {
+			resp.FinishReason = "length"
+			break
+		}
+		if stopped {
+			// 命中停止序列，关闭上游流即停止生成
+			break
+		}
+	}
+
+	upstreamLatency.Observe(time.Since(upstreamStart), metricModel(resolvedModel))
+
+	resp.Text = text.String()
+	resp.Usage.PromptTokens = estimateTokens(req.Prompt)
+	resp.Usage.CompletionTokens = estimateTokens(resp.Text)
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	if streamErr != nil {
+		return resp, streamErr
+	}
+	return resp, pipelineHooks.AfterComplete(ctx, req, resp)
+}
+
+// serveAPI 所有OpenAI兼容接口的通用处理流程
+func serveAPI(w http.ResponseWriter, r *http.Request, api *apiEndpoint) {
+	// requestIDMiddleware 分配的请求ID，响应头中已返回给客户端
+	requestID := requestIDFromContext(r.Context())
+
+	// 请求计数和耗时，模型和是否流式在解析请求后才知道
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	start := time.Now()
+	model, stream := "", false
+	// 审计记录：流式请求由 auditEntry.wrapStream 在生成结束时写入
+	var audit *auditEntry
+	auditByStream := false
+	requestsInFlight.Add(1, api.name)
+	defer func() {
+		if audit != nil && !auditByStream {
+			audit.Finish(rec.Status())
+		}
+		requestsInFlight.Add(-1, api.name)
+		requestsTotal.Inc(api.name, metricModel(model), strconv.Itoa(rec.Status()))
+		if stream {
+			streamDuration.Observe(time.Since(start), api.name)
+		} else {
+			requestDuration.Observe(time.Since(start), api.name)
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// apiKeyMiddleware 已认证的客户端key
+	key := apiKeyFromContext(r.Context())
+	baseLogger := slog.With("request_id", requestID, "api", api.name, "key", key.ID)
+	logger := baseLogger
+
+	audit = newAuditEntry(requestID, api.name, key, r)
+	// 携带 Last-Event-ID 的重连请求：补发错过的事件并继续跟随，原请求的生成另有记录
+	if resumeStream(w, r, key) {
+		stream = true
+		audit.rec.Stream, audit.rec.ResumedFrom = true, r.Header.Get("Last-Event-ID")
+		return
+	}
+
+	// 读取请求体
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("failed to read request body", "err", err)
+		audit.err = err
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// 解析为规范化请求
+	req, err := api.parse(body)
+	if err != nil {
+		logger.Error("invalid JSON payload", "err", err)
+		audit.err = err
+		http.Error(w, fmt.Sprintf("Invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.RequestID = requestID
+	req.API = api.name
+	req.KeyID = key.ID
+	req.Priority = key.Labels["priority"]
+	req.AllowedModels = key.AllowedModels
+	model, stream = req.Model, req.Stream
+	audit.req = req
+
+	// 关键信息日志 - 一行搞定
+	logger = baseLogger.With("model", req.Model)
+	logger.Info("request", "prompt_len", len(req.Prompt), "stream", req.Stream)
+
+	if err := validateRequest(req); err != nil {
+		logger.Warn("request rejected", "err", err)
+		audit.err = err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 按配置顺序执行的钩子可以改写或拒绝请求
+	if err := pipelineHooks.BeforeUpstream(r.Context(), req); err != nil {
+		logger.Warn("request rejected by hook", "err", err)
+		audit.err = err
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
+		return
+	}
+	// 钩子可能改写模型，因此在钩子之后检查
+	model = req.Model
+	logger = baseLogger.With("model", req.Model)
+	// 模型确定后加上该模型的限额，之后提前返回的错误响应也带有完整的限额状态
+	rateLimiter.Status(key, req.Model).WriteHeaders(w.Header())
+	if !key.AllowsModel(req.Model) {
+		logger.Warn("key is not allowed to use model")
+		writeOpenAIError(w, http.StatusNotFound,
+			fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", req.Model),
+			"invalid_request_error", "model_not_found")
+		return
+	}
+
+	// 每个key同时打开的流式连接有上限，超出时拒绝或排队，排队在扣除额度和限流之前。
+	// 名额交给 serveStream 后随生成结束归还，之前提前返回时在这里归还
+	var releaseStream func()
+	if req.Stream {
+		release, ok := acquireStreamSlot(w, r, key, &activeStream{
+			RequestID:  requestID,
+			API:        req.API,
+			Model:      req.Model,
+			RemoteAddr: r.RemoteAddr,
+			StartedAt:  time.Now(),
+		})
+		if !ok {
+			return
+		}
+		releaseStream = release
+		defer func() {
+			if releaseStream != nil {
+				releaseStream()
+			}
+		}()
+	}
+
+	// 每日/每月token额度，超出时不再调用上游
+	promptTokens := estimateTokens(req.Prompt)
+	quota, err := quotaTracker.Check(key, promptTokens)
+	if err != nil {
+		logger.Warn("quota exceeded", "err", err)
+		audit.err = err
+		writeOpenAIError(w, http.StatusTooManyRequests,
+			fmt.Sprintf("You exceeded your current quota: %v.", err), "insufficient_quota", "insufficient_quota")
+		return
+	}
+
+	// 按key和模型限流，响应头带上当前限额状态
+	reservation, limitStatus, ok := rateLimiter.Acquire(key, req.Model, promptTokens)
+	limitStatus.WriteHeaders(w.Header())
+	if !ok {
+		logger.Warn("rate limited", "limited_by", limitStatus.limitedBy, "retry_after", limitStatus.retryAfter)
+		writeOpenAIError(w, http.StatusTooManyRequests, limitStatus.message(key, req.Model), limitStatus.limitedBy, "rate_limit_exceeded")
+		quota.Release()
+		return
+	}
+	// 请求结束后按实际用量扣除限流token和额度
+	recordUsage := func(resp *CanonicalResponse) {
+		reservation.Commit(resp.ResolvedModel, resp.Usage.CompletionTokens)
+		quota.Record(resp.Usage.TotalTokens)
+		tokensTotal.Add(float64(resp.Usage.PromptTokens), metricModel(req.Model), "prompt")
+		tokensTotal.Add(float64(resp.Usage.CompletionTokens), metricModel(req.Model), "completion")
+	}
+
+	// 流式请求：在等待上游期间发送心跳，防止反向代理关闭空闲连接
+	if req.Stream {
+		sw, err := newSSEWriter(w)
+		if err != nil {
+			quota.Release()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stopHeartbeat := sw.StartHeartbeat(time.Duration(config.Stream.HeartbeatInterval))
+		defer stopHeartbeat()
+
+		auditByStream = true
+		release := releaseStream
+		releaseStream = nil
+		serveStream(r, sw, key.ID, release, audit.wrapStream(func(ctx context.Context, sink streamSink) *streamFailure {
+			// 没有拿到用量就结束时退还额度预留，已结算时不生效
+			defer quota.Release()
+			started := false
+			resp, err := runPipeline(ctx, req, api.idPrefix, func(resp *CanonicalResponse, text string) {
+				if !started {
+					sink.SetHeader(ResolvedModelHeader, resp.ResolvedModel)
+					started = true
+				}
+				for _, event := range api.encoder.StreamDelta(resp, text) {
+					sink.WriteData(event)
+				}
+			})
+			audit.resp, audit.err = resp, err
+			if resp == nil {
+				return upstreamFailure(ctx, err)
+			}
+			recordUsage(resp)
+			if !streamEndedCleanly(ctx, sink, err) {
+				return nil
+			}
+
+			for _, event := range api.encoder.StreamEnd(req, resp) {
+				sink.WriteData(event)
+			}
+			sink.WriteDone()
+
+			logger.Info("stream completed", "resolved", resp.ResolvedModel, "finish", resp.FinishReason)
+			return nil
+		}))
+		return
+	}
+
+	defer quota.Release()
+	resp, err := runPipeline(r.Context(), req, api.idPrefix, nil)
+	audit.resp, audit.err = resp, err
+	if resp == nil {
+		if failure := upstreamFailure(r.Context(), err); failure != nil {
+			http.Error(w, failure.message, failure.status)
+		}
+		return
+	}
+	recordUsage(resp)
+	if err != nil {
+		logger.Error("response stream failed", "err", err)
+		http.Error(w, err.Error(), upstreamErrorStatus(err))
+		return
+	}
+
+	// 空内容直接报错，不伪造助手回答；被停止序列截断的空回答除外
+	if strings.TrimSpace(resp.Text) == "" && len(req.Stop) == 0 {
+		logger.Error("empty answer", "err", errEmptyAnswer)
+		http.Error(w, errEmptyAnswer.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set(ResolvedModelHeader, resp.ResolvedModel)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.encoder.Response(resp))
+
+	logger.Info("request completed", "response_len", len(resp.Text), "resolved", resp.ResolvedModel, "finish", resp.FinishReason)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+// fakeProvider 按顺序返回固定片段的上游
+type fakeProvider struct {
+	chunks []string
+}
+
+func (p fakeProvider) Stream(ctx context.Context, req *CanonicalRequest) (deltaStream, string, error) {
+	return &sliceStream{chunks: p.chunks}, req.Model, nil
+}
+
+type sliceStream struct {
+	chunks []string
+}
+
+func (s *sliceStream) Next() (string, error) {
+	if len(s.chunks) == 0 {
+		return "", io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *sliceStream) Close() error { return nil }
+
+// useFakeProvider 在测试期间替换全局上游
+func useFakeProvider(t *testing.T, chunks ...string) {
+	t.Helper()
+	saved := provider
+	provider = fakeProvider{chunks: chunks}
+	t.Cleanup(func() { provider = saved })
+}
+
+func TestRunPipelineMaxTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		chunks     []string
+		maxTokens  int
+		wantText   string
+		wantFinish string
+	}{
+		// 被拆开的单词不会在每段都向上取整
+		{"split word within budget", []string{"ab", "cd", "ef", "gh"}, 2, "abcdefgh", "stop"},
+		{"split word over budget", []string{"ab", "cd", "ef", "gh"}, 1, "abcd", "length"},
+		{"words across chunks", []string{"hel", "lo wo", "rld again"}, 4, "hello world ", "length"},
+		{"cjk", []string{"你好", "世界"}, 3, "你好世", "length"},
+		{"exactly at budget", []string{"hello", " world"}, 4, "hello world", "stop"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFakeProvider(t, tc.chunks...)
+			maxTokens := tc.maxTokens
+			req := &CanonicalRequest{Model: "m", Prompt: "p", MaxTokens: &maxTokens}
+
+			var streamed string
+			resp, err := runPipeline(context.Background(), req, "chatcmpl", func(resp *CanonicalResponse, text string) {
+				streamed += text
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Text != tc.wantText || streamed != tc.wantText || resp.FinishReason != tc.wantFinish {
+				t.Fatalf("got text %q (streamed %q) finish %q, want %q finish %q",
+					resp.Text, streamed, resp.FinishReason, tc.wantText, tc.wantFinish)
+			}
+			if resp.Usage.CompletionTokens > maxTokens {
+				t.Fatalf("completion_tokens %d exceeds max_tokens %d", resp.Usage.CompletionTokens, maxTokens)
+			}
+			if resp.FinishReason == "length" && resp.Usage.CompletionTokens != maxTokens {
+				t.Fatalf("cut for length at %d completion tokens, max_tokens %d", resp.Usage.CompletionTokens, maxTokens)
+			}
+		})
+	}
+}
+
+func TestRunPipelineStop(t *testing.T) {
+	useFakeProvider(t, "Hello", " wor", "ld. Bye")
+	req := &CanonicalRequest{Model: "m", Prompt: "p", Stop: []string{"world"}}
+
+	resp, err := runPipeline(context.Background(), req, "chatcmpl", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Hello " || resp.FinishReason != "stop" {
+		t.Fatalf("got %q finish %q", resp.Text, resp.FinishReason)
+	}
+	if resp.Usage.CompletionTokens != estimateTokens("Hello ") || resp.Usage.PromptTokens != 1 {
+		t.Fatalf("usage = %+v", resp.Usage)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 用量计数写回文件的间隔
+const quotaFlushInterval = 10 * time.Second
+
+// keyUsage 一个key在当前日、当前月的token用量
+type keyUsage struct {
+	Day         string    `json:"day"` // 2006-01-02
+	DayTokens   int       `json:"day_tokens"`
+	Month       string    `json:"month"` // 2006-01
+	MonthTokens int       `json:"month_tokens"`
+	LastUpdated time.Time `json:"last_updated"`
+}
+
+// rollover 进入新的一天或新的一月时清零对应计数
+func (u *keyUsage) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayTokens = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthTokens = month, 0
+	}
+}
+
+// QuotaTracker 统计每个key按日、按月的token用量并持久化，计数在所配置时区的零点/月初重置
+type QuotaTracker struct {
+	mu    sync.Mutex
+	path  string
+	loc   *time.Location
+	usage map[string]*keyUsage
+	dirty bool
+}
+
+// 全局用量统计，startServer 按配置初始化
+var quotaTracker = &QuotaTracker{loc: time.Local, usage: map[string]*keyUsage{}}
+
+// NewQuotaTracker 从状态目录下的 usage.json 加载已有计数
+func NewQuotaTracker(cfg QuotaConfig, stateDir string) (*QuotaTracker, error) {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("无效的时区 %q: %v", cfg.Timezone, err)
+		}
+	}
+
+	t := &QuotaTracker{
+		path:  filepath.Join(stateDir, "usage.json"),
+		loc:   loc,
+		usage: map[string]*keyUsage{},
+	}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.usage); err != nil {
+		return nil, fmt.Errorf("解析用量文件 %s 失败: %v", t.path, err)
+	}
+	return t, nil
+}
+
+// quotaStatus 检查不通过时的详情
+type quotaStatus struct {
+	period string // "daily" 或 "monthly"
+	limit  int
+	used   int
+	resets time.Time
+}
+
+func (s *quotaStatus) Error() string {
+	return fmt.Sprintf("%s token quota of %d reached (used %d), resets at %s",
+		s.period, s.limit, s.used, s.resets.Format(time.RFC3339))
+}
+
+// quotaReservation Check 为一次请求预留的prompt token，请求结束后用 Record 按实际用量结算
+type quotaReservation struct {
+	tracker *QuotaTracker
+	keyID   string
+	tokens  int
+	day     string // 预留计入的日期和月份，跨零点/月初后预留已随计数清零
+	month   string
+	settled bool
+}
+
+// Check 在调用上游前检查key的额度：已用量加上本次prompt超过额度时拒绝，
+// 通过时在同一把锁内预留prompt的token，避免并发请求同时通过检查后一起超额。
+// key没有设置额度时返回nil
+func (t *QuotaTracker) Check(key *APIKey, promptTokens int) (*quotaReservation, error) {
+	limits := key.Limits
+	if limits.DailyTokens <= 0 && limits.MonthlyTokens <= 0 {
+		return nil, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().In(t.loc)
+	u := t.usageLocked(key.ID, now)
+	if limits.DailyTokens > 0 && u.DayTokens+promptTokens > limits.DailyTokens {
+		year, month, day := now.Date()
+		return nil, &quotaStatus{period: "daily", limit: limits.DailyTokens, used: u.DayTokens,
+			resets: time.Date(year, month, day+1, 0, 0, 0, 0, t.loc)}
+	}
+	if limits.MonthlyTokens > 0 && u.MonthTokens+promptTokens > limits.MonthlyTokens {
+		year, month, _ := now.Date()
+		return nil, &quotaStatus{period: "monthly", limit: limits.MonthlyTokens, used: u.MonthTokens,
+			resets: time.Date(year, month+1, 1, 0, 0, 0, 0, t.loc)}
+	}
+
+	u.DayTokens += promptTokens
+	u.MonthTokens += promptTokens
+	u.LastUpdated = now
+	t.dirty = true
+	return &quotaReservation{tracker: t, keyID: key.ID, tokens: promptTokens, day: u.Day, month: u.Month}, nil
+}
+
+// Record 按请求实际消耗的token结算预留，只有第一次调用生效
+func (r *quotaReservation) Record(tokens int) {
+	if r == nil {
+		return
+	}
+	t := r.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.settled {
+		return
+	}
+	r.settled = true
+
+	now := time.Now().In(t.loc)
+	u := t.usageLocked(r.keyID, now)
+	// 预留仍在当前计数中时只补差额，否则计入全部用量
+	if u.Day == r.day {
+		u.DayTokens += tokens - r.tokens
+	} else {
+		u.DayTokens += tokens
+	}
+	if u.Month == r.month {
+		u.MonthTokens += tokens - r.tokens
+	} else {
+		u.MonthTokens += tokens
+	}
+	u.LastUpdated = now
+	t.dirty = true
+}
+
+// Release 请求没有产生用量（被限流或上游失败）时退还预留
+func (r *quotaReservation) Release() {
+	r.Record(0)
+}
+
+func (t *QuotaTracker) usageLocked(keyID string, now time.Time) *keyUsage {
+	u, ok := t.usage[keyID]
+	if !ok {
+		u = &keyUsage{}
+		t.usage[keyID] = u
+	}
+	u.rollover(now)
+	return u
+}
+
+// Run 定期把计数写回文件，ctx结束时返回；退出前由调用方再 Flush 一次
+func (t *QuotaTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.Flush(); err != nil {
+			slog.Warn("保存用量计数失败", "path", t.path, "err", err)
+		}
+	}
+}
+
+// Flush 有未保存的计数时写回文件
+func (t *QuotaTracker) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.dirty || t.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(t.path, data, 0o600); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
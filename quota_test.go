@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{loc: time.UTC, usage: map[string]*keyUsage{}}
+}
+
+// 并发请求在同一把锁内预留prompt，不会一起越过额度
+func TestQuotaCheckReservesConcurrently(t *testing.T) {
+	tracker := newTestQuotaTracker()
+	key := &APIKey{ID: "k", Limits: KeyLimits{DailyTokens: 1000}}
+
+	var passed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tracker.Check(key, 100); err == nil {
+				passed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if passed.Load() != 10 {
+		t.Fatalf("%d requests passed, want 10", passed.Load())
+	}
+	if used := tracker.usage["k"].DayTokens; used != 1000 {
+		t.Fatalf("day tokens = %d, want 1000", used)
+	}
+}
+
+func TestQuotaReservationRecord(t *testing.T) {
+	tracker := newTestQuotaTracker()
+	key := &APIKey{ID: "k", Limits: KeyLimits{DailyTokens: 1000, MonthlyTokens: 5000}}
+
+	r, err := tracker.Check(key, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Record(250)
+	r.Record(999) // 只结算一次
+	r.Release()
+	if u := tracker.usage["k"]; u.DayTokens != 250 || u.MonthTokens != 250 {
+		t.Fatalf("usage = %+v, want 250", u)
+	}
+
+	// 被限流或上游失败时退还预留
+	r, err = tracker.Check(key, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := tracker.usage["k"]; u.DayTokens != 550 {
+		t.Fatalf("day tokens while reserved = %d, want 550", u.DayTokens)
+	}
+	r.Release()
+	if u := tracker.usage["k"]; u.DayTokens != 250 {
+		t.Fatalf("day tokens after release = %d, want 250", u.DayTokens)
+	}
+
+	// 预留跨过零点后计数已清零，结算时计入全部用量
+	r, _ = tracker.Check(key, 100)
+	r.day = "2000-01-01"
+	tracker.usage["k"].Day = r.day
+	r.Record(40)
+	if u := tracker.usage["k"]; u.DayTokens != 40 || u.MonthTokens != 290 {
+		t.Fatalf("usage = %+v, want day 40 month 290", u)
+	}
+}
+
+func TestQuotaCheckRejects(t *testing.T) {
+	tracker := newTestQuotaTracker()
+	key := &APIKey{ID: "k", Limits: KeyLimits{MonthlyTokens: 100}}
+
+	r, err := tracker.Check(key, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.Check(key, 30); err == nil {
+		t.Fatal("reserved tokens not counted against the quota")
+	} else if status, ok := err.(*quotaStatus); !ok || status.period != "monthly" || status.used != 80 {
+		t.Fatalf("err = %v", err)
+	}
+	r.Record(50)
+	if _, err := tracker.Check(key, 30); err != nil {
+		t.Fatalf("after settling below the estimate: %v", err)
+	}
+
+	if r, err := tracker.Check(&APIKey{ID: "anon"}, 1<<30); r != nil || err != nil {
+		t.Fatalf("key without quota: %v %v", r, err)
+	}
+	var nilReservation *quotaReservation
+	nilReservation.Record(10)
+	nilReservation.Release()
+	if _, ok := tracker.usage["anon"]; ok {
+		t.Fatal("key without quota should not be tracked")
+	}
+}
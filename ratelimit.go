@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit 每分钟的请求数和token数上限，0表示不限制
+type RateLimit struct {
+	RPM int `json:"rpm"`
+	TPM int `json:"tpm"`
+}
+
+// 空闲的令牌桶回满后超过这么久没有使用就被清理
+const rateLimitIdleTTL = 10 * time.Minute
+
+// tokenBucket 令牌桶：容量为每分钟上限，按上限/60每秒匀速补充。
+// token桶允许被请求结束后的实际用量扣成负数，之后的请求需要等待补回
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // 每秒补充的数量
+	updated  time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		tokens:   float64(perMinute),
+		rate:     float64(perMinute) / 60,
+		updated:  now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = min(b.capacity, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// wait 返回桶里攒够n个令牌还需要的时间。超过容量的请求只需等到桶满，否则永远无法通过
+func (b *tokenBucket) wait(n float64) time.Duration {
+	n = min(n, b.capacity)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// resetIn 返回桶补满需要的时间
+func (b *tokenBucket) resetIn() time.Duration {
+	return time.Duration((b.capacity - b.tokens) / b.rate * float64(time.Second))
+}
+
+// RateLimiter 按客户端key（以及key+模型）限制请求速率
+type RateLimiter struct {
+	mu        sync.Mutex
+	def       RateLimit
+	models    map[string]RateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// 全局限流器，startServer 按配置初始化
+var rateLimiter = NewRateLimiter(RateLimitConfig{})
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		def:     cfg.Default,
+		models:  cfg.Models,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// 一个限流范围（key或key+模型）在本次请求中涉及的桶
+type rateScope struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+// rateReservation 已通过限流的请求，结束后用 Commit 扣除回答的token
+type rateReservation struct {
+	limiter      *RateLimiter
+	key          *APIKey
+	model        string // 请求的模型
+	promptTokens int
+	scopes       []rateScope
+}
+
+// rateLimitStatus 写入 x-ratelimit-* 响应头的状态，取所有范围中剩余最少的一个
+type rateLimitStatus struct {
+	limitRequests, remainingRequests int
+	limitTokens, remainingTokens     int
+	resetRequests, resetTokens       time.Duration
+	retryAfter                       time.Duration // 被限流时需要等待的时间
+	limitedBy                        string        // "requests" 或 "tokens"
+}
+
+// 返回key的限额：key自己的设置优先，未设置时使用默认值
+func (l *RateLimiter) keyLimit(key *APIKey) RateLimit {
+	limit := l.def
+	if key.Limits.RPM > 0 {
+		limit.RPM = key.Limits.RPM
+	}
+	if key.Limits.TPM > 0 {
+		limit.TPM = key.Limits.TPM
+	}
+	return limit
+}
+
+// 取出或创建桶；key的限额被修改后按新容量重建
+func (l *RateLimiter) bucketLocked(name string, perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	b, ok := l.buckets[name]
+	if !ok || b.capacity != float64(perMinute) {
+		b = newTokenBucket(perMinute, now)
+		l.buckets[name] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// 本次请求涉及的所有限流范围：key本身，以及配置了模型限额时的key+模型
+func (l *RateLimiter) scopesLocked(key *APIKey, model string, now time.Time) []rateScope {
+	keyLimit := l.keyLimit(key)
+	scopes := []rateScope{{
+		requests: l.bucketLocked("rpm:"+key.ID, keyLimit.RPM, now),
+		tokens:   l.bucketLocked("tpm:"+key.ID, keyLimit.TPM, now),
+	}}
+	if modelLimit, ok := l.models[model]; ok {
+		scopes = append(scopes, rateScope{
+			requests: l.bucketLocked("rpm:"+key.ID+":"+model, modelLimit.RPM, now),
+			tokens:   l.bucketLocked("tpm:"+key.ID+":"+model, modelLimit.TPM, now),
+		})
+	}
+	return scopes
+}
+
+// 没有任何限额时返回nil
+func newRateLimitStatus(scopes []rateScope) *rateLimitStatus {
+	for _, scope := range scopes {
+		if scope.requests != nil || scope.tokens != nil {
+			return &rateLimitStatus{remainingRequests: math.MaxInt, remainingTokens: math.MaxInt}
+		}
+	}
+	return nil
+}
+
+// 按各桶当前的令牌数填入剩余最少的限额
+func (s *rateLimitStatus) fillRemaining(scopes []rateScope) {
+	for _, scope := range scopes {
+		if b := scope.requests; b != nil && int(b.tokens) < s.remainingRequests {
+			s.limitRequests, s.remainingRequests, s.resetRequests = int(b.capacity), max(0, int(b.tokens)), b.resetIn()
+		}
+		if b := scope.tokens; b != nil && int(b.tokens) < s.remainingTokens {
+			s.limitTokens, s.remainingTokens, s.resetTokens = int(b.capacity), max(0, int(b.tokens)), b.resetIn()
+		}
+	}
+}
+
+// Status 返回key对model的当前限额状态，不扣除任何令牌，用于在请求被其他原因拒绝时也返回响应头。
+// model为空时只包含key本身的限额；没有任何限额时返回nil
+func (l *RateLimiter) Status(key *APIKey, model string) *rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	scopes := l.scopesLocked(key, model, time.Now())
+	status := newRateLimitStatus(scopes)
+	if status != nil {
+		status.fillRemaining(scopes)
+	}
+	return status
+}
+
+// Acquire 检查key对model的请求是否超过限额，promptTokens为本地估算的prompt token数。
+// 通过时立即扣除一个请求和prompt的token；ok为false时请求应以429拒绝。
+// 没有任何限额时返回的status为nil
+func (l *RateLimiter) Acquire(key *APIKey, model string, promptTokens int) (*rateReservation, *rateLimitStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweepLocked(now)
+
+	scopes := l.scopesLocked(key, model, now)
+	status := newRateLimitStatus(scopes)
+	reservation := &rateReservation{limiter: l, key: key, model: model, promptTokens: promptTokens, scopes: scopes}
+	if status == nil {
+		return reservation, nil, true
+	}
+
+	// 先检查所有桶，全部通过后再扣除，避免部分扣除
+	for _, scope := range scopes {
+		if b := scope.requests; b != nil {
+			if wait := b.wait(1); wait > status.retryAfter {
+				status.retryAfter, status.limitedBy = wait, "requests"
+			}
+		}
+		if b := scope.tokens; b != nil {
+			if wait := b.wait(float64(promptTokens)); wait > status.retryAfter {
+				status.retryAfter, status.limitedBy = wait, "tokens"
+			}
+		}
+	}
+
+	ok := status.retryAfter == 0
+	if ok {
+		for _, scope := range scopes {
+			if scope.requests != nil {
+				scope.requests.tokens--
+			}
+			if scope.tokens != nil {
+				scope.tokens.tokens -= float64(promptTokens)
+			}
+		}
+	}
+
+	status.fillRemaining(scopes)
+	if !ok {
+		return nil, status, false
+	}
+	return reservation, status, true
+}
+
+// Commit 请求结束后扣除回答消耗的token。回退到备用模型时，准入时还不知道实际回答的模型，
+// 因此在这里对该模型的限额事后扣除一个请求和全部token，影响之后请求该模型的准入
+func (r *rateReservation) Commit(resolvedModel string, completionTokens int) {
+	if r == nil {
+		return
+	}
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+
+	now := time.Now()
+	if completionTokens > 0 {
+		for _, scope := range r.scopes {
+			if scope.tokens != nil {
+				scope.tokens.refill(now)
+				scope.tokens.tokens -= float64(completionTokens)
+			}
+		}
+	}
+
+	if resolvedModel == "" || resolvedModel == r.model {
+		return
+	}
+	if modelLimit, ok := r.limiter.models[resolvedModel]; ok {
+		if b := r.limiter.bucketLocked("rpm:"+r.key.ID+":"+resolvedModel, modelLimit.RPM, now); b != nil {
+			b.tokens--
+		}
+		if b := r.limiter.bucketLocked("tpm:"+r.key.ID+":"+resolvedModel, modelLimit.TPM, now); b != nil {
+			b.tokens -= float64(r.promptTokens + completionTokens)
+		}
+	}
+}
+
+// 定期清理长时间未使用的桶（此时早已回满，重建等价）
+func (l *RateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for name, b := range l.buckets {
+		if now.Sub(b.updated) > rateLimitIdleTTL {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+// 与OpenAI相同格式的时长，例如 "1s"、"6m0s"、"250ms"
+func formatRateReset(d time.Duration) string {
+	if d <= 0 {
+		return "0s"
+	}
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	// 向上取整，与 retry-after 一致，按提示等待后一定能通过
+	return (time.Duration(math.Ceil(d.Seconds())) * time.Second).String()
+}
+
+// WriteHeaders 写入 x-ratelimit-* 响应头，只写出配置了限额的维度
+func (s *rateLimitStatus) WriteHeaders(h http.Header) {
+	if s == nil {
+		return
+	}
+	if s.limitRequests > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(s.limitRequests))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(s.remainingRequests))
+		h.Set("x-ratelimit-reset-requests", formatRateReset(s.resetRequests))
+	}
+	if s.limitTokens > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(s.limitTokens))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(s.remainingTokens))
+		h.Set("x-ratelimit-reset-tokens", formatRateReset(s.resetTokens))
+	}
+	if s.retryAfter > 0 {
+		h.Set("retry-after", strconv.Itoa(int(math.Ceil(s.retryAfter.Seconds()))))
+	}
+}
+
+// 被限流时返回给客户端的错误信息
+func (s *rateLimitStatus) message(key *APIKey, model string) string {
+	limit, unit := s.limitRequests, "requests per min (RPM)"
+	if s.limitedBy == "tokens" {
+		limit, unit = s.limitTokens, "tokens per min (TPM)"
+	}
+	return fmt.Sprintf("Rate limit reached for %s on %s for key %s: Limit %d %s. Please try again in %s.",
+		model, s.limitedBy, key.ID, limit, unit, formatRateReset(s.retryAfter))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useRateLimiter 在测试期间替换全局限流器
+func useRateLimiter(t *testing.T, cfg RateLimitConfig) {
+	t.Helper()
+	saved := rateLimiter
+	rateLimiter = NewRateLimiter(cfg)
+	t.Cleanup(func() { rateLimiter = saved })
+}
+
+func TestRateLimiterStatusDoesNotConsume(t *testing.T) {
+	useRateLimiter(t, RateLimitConfig{
+		Default: RateLimit{RPM: 10, TPM: 1000},
+		Models:  map[string]RateLimit{"m": {RPM: 2}},
+	})
+	key := &APIKey{ID: "k"}
+
+	for range 3 {
+		status := rateLimiter.Status(key, "")
+		if status.remainingRequests != 10 || status.remainingTokens != 1000 {
+			t.Fatalf("status = %+v, want untouched buckets", status)
+		}
+	}
+	if status := rateLimiter.Status(key, "m"); status.limitRequests != 2 || status.remainingRequests != 2 {
+		t.Fatalf("model status = %+v, want the tighter model limit", status)
+	}
+
+	if _, _, ok := rateLimiter.Acquire(key, "m", 100); !ok {
+		t.Fatal("first request limited")
+	}
+	status := rateLimiter.Status(key, "m")
+	if status.remainingRequests != 1 || status.remainingTokens != 900 || status.retryAfter != 0 {
+		t.Fatalf("status after acquire = %+v", status)
+	}
+
+	if NewRateLimiter(RateLimitConfig{}).Status(key, "m") != nil {
+		t.Fatal("status without limits should be nil")
+	}
+}
+
+// 被提前拒绝的请求和 /v1/models 同样带有限额响应头
+func TestRateLimitHeadersOnEveryResponse(t *testing.T) {
+	useRateLimiter(t, RateLimitConfig{Default: RateLimit{RPM: 10, TPM: 1000}})
+	useFakeProvider(t, "hi")
+
+	do := func(handler http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/x", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-test")
+		rec := httptest.NewRecorder()
+		apiKeyMiddleware(handler)(rec, req)
+		return rec
+	}
+	for _, tc := range []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		body       string
+		wantStatus int
+		wantRemain string
+	}{
+		{"invalid json", handleChatCompletions, http.MethodPost, `{`, http.StatusBadRequest, "10"},
+		{"invalid request", handleChatCompletions, http.MethodPost, `{"model":"m","messages":[]}`, http.StatusBadRequest, "10"},
+		{"wrong method", handleChatCompletions, http.MethodGet, ``, http.StatusMethodNotAllowed, "10"},
+		{"models", handleModels, http.MethodGet, ``, http.StatusOK, "10"},
+		{"completed", handleChatCompletions, http.MethodPost, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, "9"},
+	} {
+		rec := do(tc.handler, tc.method, tc.body)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.wantStatus, rec.Body)
+			continue
+		}
+		if got := rec.Header().Get("x-ratelimit-remaining-requests"); got != tc.wantRemain {
+			t.Errorf("%s: x-ratelimit-remaining-requests = %q, want %q", tc.name, got, tc.wantRemain)
+		}
+		if rec.Header().Get("x-ratelimit-limit-tokens") != "1000" {
+			t.Errorf("%s: missing x-ratelimit-limit-tokens", tc.name)
+		}
+	}
+}
+
+func TestRateLimitHeadersOnModelNotFound(t *testing.T) {
+	useRateLimiter(t, RateLimitConfig{Default: RateLimit{RPM: 10}})
+	key := &APIKey{ID: "k", Enabled: true, AllowedModels: []string{"other"}}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+	rec := httptest.NewRecorder()
+	handleChatCompletions(rec, req)
+
+	if rec.Code != http.StatusNotFound || rec.Header().Get("x-ratelimit-remaining-requests") != "10" {
+		t.Fatalf("status %d, headers %v", rec.Code, rec.Header())
+	}
+}
+
+// 回退到备用模型时，实际回答的模型的限额同样被扣除
+func TestRateLimitChargesResolvedModel(t *testing.T) {
+	useRateLimiter(t, RateLimitConfig{Models: map[string]RateLimit{"doubao": {RPM: 1, TPM: 100}}})
+	key := &APIKey{ID: "k"}
+
+	// 没有适用于qwen的限额，准入时不扣除任何桶
+	reservation, status, ok := rateLimiter.Acquire(key, "qwen", 30)
+	if !ok || status != nil {
+		t.Fatalf("ok = %v, status = %+v", ok, status)
+	}
+	reservation.Commit("doubao", 20)
+	status = rateLimiter.Status(key, "doubao")
+	if status.remainingRequests != 0 || status.remainingTokens != 50 {
+		t.Fatalf("doubao status after fallback = %+v, want 1 request and 50 tokens used", status)
+	}
+	if _, _, ok := rateLimiter.Acquire(key, "doubao", 1); ok {
+		t.Fatal("doubao request accepted after the fallback used its only request")
+	}
+
+	// 由请求的模型回答时不重复扣除
+	useRateLimiter(t, RateLimitConfig{Models: map[string]RateLimit{"doubao": {RPM: 2}}})
+	reservation, _, _ = rateLimiter.Acquire(key, "doubao", 30)
+	reservation.Commit("doubao", 20)
+	if status := rateLimiter.Status(key, "doubao"); status.remainingRequests != 1 {
+		t.Fatalf("doubao status = %+v, want a single request used", status)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestIDHeader 客户端可以通过该请求头指定请求ID，响应中以同名头返回
+const RequestIDHeader = "X-Request-ID"
+
+// ProcessingTimeHeader 从收到请求到开始写响应的毫秒数，与OpenAI的响应头同名
+const ProcessingTimeHeader = "openai-processing-ms"
+
+// 客户端指定的请求ID的最大长度
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// newRequestID 生成随机的请求ID，同一秒内的请求也不会重复
+func newRequestID() string {
+	return "req_" + randomHex(12)
+}
+
+// validRequestID 只接受长度合理、由字母数字和 ._:- 组成的ID，避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext 返回 requestIDMiddleware 分配的请求ID，不在请求中时为空
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withRequestID 把请求ID放入ctx，用于不从请求context派生的后台处理
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// requestIDMiddleware 为每个请求分配ID：沿用客户端的 X-Request-ID，否则生成新的。
+// 所有响应都带有 x-request-id 和处理耗时头
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		tw := &timingWriter{ResponseWriter: w, start: start}
+		next.ServeHTTP(tw, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// timingWriter 在写出响应头时加上处理耗时；流式响应为到第一个字节的时间
+type timingWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func (t *timingWriter) WriteHeader(status int) {
+	if !t.wroteHeader {
+		t.wroteHeader = true
+		t.Header().Set(ProcessingTimeHeader, strconv.FormatInt(time.Since(t.start).Milliseconds(), 10))
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *timingWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *timingWriter) Flush() {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *timingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
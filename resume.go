@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamSink 流式事件的去处：直接写给客户端的 sseWriter，或可续传的 streamBuffer
+type streamSink interface {
+	SetHeader(key, value string) // 在第一个事件之前设置响应头
+	WriteData(v any)
+	WriteDone()
+	WriteError(message, code string)
+}
+
+// 生成开始前失败（尚无任何事件）时返回给客户端的错误
+type streamFailure struct {
+	status  int
+	message string
+	code    string
+}
+
+// 所有请求的父context，startServer 设置为可在关闭时取消的context。
+// 可续传的流在后台生成，不随单个客户端连接结束，但会随服务关闭取消
+var serverCtx = context.Background()
+
+// 客户端断开后仍在后台进行的生成，退出时等待它们写完审计记录和用量
+var detachedStreams = &sync.WaitGroup{}
+
+// waitDetachedStreams 等待后台生成全部结束，ctx到期时返回其错误
+func waitDetachedStreams(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		detachedStreams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 全局可续传流缓存
+var resumableStreams = newStreamHub()
+
+// streamHub 保存进行中和最近结束的流，用于断线重连时补发事件
+type streamHub struct {
+	mu      sync.Mutex
+	streams map[string]*streamBuffer
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{streams: make(map[string]*streamBuffer)}
+}
+
+// Create 登记一个新的流，同时清理超出保留时间的已结束流
+func (h *streamHub) Create(owner, requestID string, cancel context.CancelFunc) *streamBuffer {
+	idBytes := make([]byte, 12)
+	rand.Read(idBytes)
+
+	b := &streamBuffer{
+		id:        "strm_" + hex.EncodeToString(idBytes),
+		owner:     owner,
+		requestID: requestID,
+		cancel:    cancel,
+		notify:    make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	window := time.Duration(config.Stream.ResumeWindow)
+	for id, old := range h.streams {
+		if old.expired(window) {
+			delete(h.streams, id)
+		}
+	}
+	h.streams[b.id] = b
+	return b
+}
+
+// Lookup 根据 Last-Event-ID（格式为 "<流ID>:<序号>"）查找流，返回流和客户端已收到的事件数
+func (h *streamHub) Lookup(lastEventID string) (*streamBuffer, int, bool) {
+	id, seqStr, found := strings.Cut(lastEventID, ":")
+	if !found {
+		return nil, 0, false
+	}
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil || seq < 0 {
+		return nil, 0, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.streams[id]
+	if !ok || b.expired(time.Duration(config.Stream.ResumeWindow)) {
+		return nil, 0, false
+	}
+	return b, seq, true
+}
+
+// streamBuffer 缓存一个流的全部事件，支持多个订阅者从任意位置跟随
+type streamBuffer struct {
+	id        string
+	owner     string // 创建者的API key，重连时校验
+	requestID string // 创建流的请求，用于日志
+	cancel    context.CancelFunc
+
+	mu          sync.Mutex
+	headers     map[string]string
+	events      []string // 已编码的 data 负载
+	finished    bool
+	finishedAt  time.Time
+	failure     *streamFailure
+	notify      chan struct{} // 有新事件或流结束时关闭并替换
+	subscribers int
+	idleTimer   *time.Timer
+}
+
+// 已结束且超过保留时间
+func (b *streamBuffer) expired(window time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.finished && time.Since(b.finishedAt) > window
+}
+
+// 追加一个事件并唤醒订阅者，调用方需持有锁
+func (b *streamBuffer) appendLocked(data string) {
+	b.events = append(b.events, data)
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+func (b *streamBuffer) SetHeader(key, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.headers == nil {
+		b.headers = make(map[string]string)
+	}
+	b.headers[key] = value
+}
+
+func (b *streamBuffer) WriteData(v any) {
+	data, _ := json.Marshal(v)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.appendLocked(string(data))
+}
+
+func (b *streamBuffer) WriteDone() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.appendLocked("[DONE]")
+}
+
+func (b *streamBuffer) WriteError(message, code string) {
+	b.WriteData(streamErrorPayload(message, code))
+}
+
+// finish 标记流结束；failure 非空表示在产生任何事件之前就失败了
+func (b *streamBuffer) finish(failure *streamFailure) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.finished = true
+	b.finishedAt = time.Now()
+	b.failure = failure
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// 订阅者接入，取消等待中的闲置取消
+func (b *streamBuffer) attach() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers++
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+		b.idleTimer = nil
+	}
+}
+
+// 订阅者离开；若流仍在生成且无人订阅，resume_grace 后取消上游请求
+func (b *streamBuffer) detach() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers--
+	if b.subscribers > 0 || b.finished {
+		return
+	}
+	grace := time.Duration(config.Stream.ResumeGrace)
+	b.idleTimer = time.AfterFunc(grace, func() {
+		slog.Info("no client reconnected, cancelling upstream", "request_id", b.requestID, "stream_id", b.id, "grace", grace)
+		b.cancel()
+	})
+}
+
+// Subscribe 把第after个之后的事件写给客户端并持续跟随，直到流结束或客户端断开。
+// 流在产生任何事件前失败时返回该失败，由调用方返回HTTP错误
+func (b *streamBuffer) Subscribe(ctx context.Context, sw *sseWriter, after int) *streamFailure {
+	b.attach()
+	defer b.detach()
+
+	next := after
+	for {
+		b.mu.Lock()
+		if next > len(b.events) {
+			next = len(b.events)
+		}
+		pending := b.events[next:]
+		finished, failure, notify := b.finished, b.failure, b.notify
+		for key, value := range b.headers {
+			sw.SetHeader(key, value)
+		}
+		b.mu.Unlock()
+
+		for i, data := range pending {
+			sw.WriteEvent(b.id+":"+strconv.Itoa(next+i+1), data)
+		}
+		next += len(pending)
+
+		if finished {
+			return failure
+		}
+
+		select {
+		case <-ctx.Done():
+			if isShuttingDown(ctx) {
+				sw.WriteError(errServerShutdown.Error(), "server_shutdown")
+			}
+			return nil
+		case <-notify:
+		}
+	}
+}
+
+// serveStream 运行produce生成流式事件并写给客户端。
+// 启用续传时生成在后台进行，事件缓存在 resumableStreams 中，客户端可携带 Last-Event-ID 重连；
+// 否则直接写给客户端，客户端断开即取消上游。
+// release 归还流式连接名额，在生成结束（包括无人重连被取消）后调用，而不是在本次连接结束时
+func serveStream(r *http.Request, sw *sseWriter, owner string, release func(),
+	produce func(ctx context.Context, sink streamSink) *streamFailure) {
+	if time.Duration(config.Stream.ResumeWindow) <= 0 {
+		defer release()
+		if failure := produce(r.Context(), sw); failure != nil {
+			sw.Fail(failure.status, failure.message, failure.code)
+		}
+		return
+	}
+
+	// 生成不随客户端连接取消，但保留请求ID以便日志关联
+	requestID := requestIDFromContext(r.Context())
+	ctx, cancel := context.WithCancelCause(withRequestID(serverCtx, requestID))
+	buf := resumableStreams.Create(owner, requestID, func() { cancel(context.Canceled) })
+	detachedStreams.Add(1)
+	go func() {
+		defer detachedStreams.Done()
+		defer release()
+		defer cancel(nil)
+		buf.finish(produce(ctx, buf))
+	}()
+
+	if failure := buf.Subscribe(r.Context(), sw, 0); failure != nil {
+		sw.Fail(failure.status, failure.message, failure.code)
+	}
+}
+
+// resumeStream 处理携带 Last-Event-ID 的重连请求，补发错过的事件后继续跟随。
+// 请求不是重连时返回false，由调用方按新请求处理
+func resumeStream(w http.ResponseWriter, r *http.Request, key *APIKey) bool {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" || time.Duration(config.Stream.ResumeWindow) <= 0 {
+		return false
+	}
+
+	buf, seq, ok := resumableStreams.Lookup(lastEventID)
+	if !ok || buf.owner != key.ID {
+		slog.WarnContext(r.Context(), "cannot resume stream", "key", key.ID, "last_event_id", lastEventID)
+		http.Error(w, "Stream not found or expired", http.StatusNotFound)
+		return true
+	}
+
+	// 重连跟随的生成仍占用着原请求的流式连接名额，不再另外占用，否则名额用满时无法续传
+
+	sw, err := newSSEWriter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	stopHeartbeat := sw.StartHeartbeat(time.Duration(config.Stream.HeartbeatInterval))
+	defer stopHeartbeat()
+
+	slog.InfoContext(r.Context(), "resuming stream", "key", key.ID, "stream_id", buf.id, "after_event", seq)
+	if failure := buf.Subscribe(r.Context(), sw, seq); failure != nil {
+		sw.Fail(failure.status, failure.message, failure.code)
+	}
+	return true
+}
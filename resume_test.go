@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useStreamConfig 在测试期间替换流式配置和连接统计
+func useStreamConfig(t *testing.T, cfg StreamConfig) {
+	t.Helper()
+	savedConfig, savedTracker := config, streamTracker
+	copied := *config
+	copied.Stream = cfg
+	config = &copied
+	streamTracker = NewStreamTracker(cfg)
+	t.Cleanup(func() { config, streamTracker = savedConfig, savedTracker })
+}
+
+func activeStreams() int {
+	n := 0
+	for _, ks := range streamTracker.Snapshot() {
+		n += ks.Active
+	}
+	return n
+}
+
+// 占用名额后运行 serveStream，客户端在第一个事件后断开
+func serveDetachedStream(t *testing.T, key *APIKey, produce func(ctx context.Context, sink streamSink) *streamFailure) *httptest.ResponseRecorder {
+	t.Helper()
+	release, err := streamTracker.Acquire(context.Background(), key, &activeStream{RequestID: "req"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	sw, err := newSSEWriter(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveStream(httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx), sw, key.ID, release,
+			func(ctx context.Context, sink streamSink) *streamFailure {
+				sink.WriteData(map[string]string{"text": "first"})
+				close(started)
+				return produce(ctx, sink)
+			})
+	}()
+	<-started
+	disconnect()
+	<-done
+	return rec
+}
+
+// 客户端断开后生成仍在后台进行，名额在生成结束时才归还
+func TestStreamSlotHeldUntilGenerationFinishes(t *testing.T) {
+	useStreamConfig(t, StreamConfig{ResumeWindow: Duration(time.Minute), ResumeGrace: Duration(time.Minute), MaxPerKey: 1})
+	key := &APIKey{ID: "k"}
+
+	proceed := make(chan struct{})
+	rec := serveDetachedStream(t, key, func(ctx context.Context, sink streamSink) *streamFailure {
+		<-proceed
+		sink.WriteData(map[string]string{"text": "second"})
+		sink.WriteDone()
+		return nil
+	})
+	if activeStreams() != 1 {
+		t.Fatalf("active streams after disconnect = %d, want the generation to keep its slot", activeStreams())
+	}
+	if _, err := streamTracker.Acquire(context.Background(), key, &activeStream{}); err == nil {
+		t.Fatal("new stream accepted while the detached generation holds the only slot")
+	}
+
+	// 重连跟随原来的生成，不另外占用名额
+	id := regexp.MustCompile(`id: (strm_[0-9a-f]+):1`).FindStringSubmatch(rec.Body.String())
+	if id == nil {
+		t.Fatalf("no event id in %q", rec.Body.String())
+	}
+	resumeReq := httptest.NewRequest(http.MethodPost, "/", nil)
+	resumeReq.Header.Set("Last-Event-ID", id[1]+":1")
+	resumed := httptest.NewRecorder()
+	close(proceed)
+	if !resumeStream(resumed, resumeReq, key) {
+		t.Fatal("resume request not handled")
+	}
+	if want := "id: " + id[1] + ":2\ndata: {\"text\":\"second\"}\n\n"; resumed.Code != http.StatusOK || !regexp.MustCompile(regexp.QuoteMeta(want)).MatchString(resumed.Body.String()) {
+		t.Fatalf("resumed status %d body %q", resumed.Code, resumed.Body.String())
+	}
+
+	waitFor(t, func() bool { return activeStreams() == 0 })
+}
+
+// 无人重连时 resume_grace 后取消生成并归还名额
+func TestStreamSlotReleasedWhenGraceExpires(t *testing.T) {
+	useStreamConfig(t, StreamConfig{ResumeWindow: Duration(time.Minute), ResumeGrace: Duration(20 * time.Millisecond), MaxPerKey: 1})
+
+	serveDetachedStream(t, &APIKey{ID: "k"}, func(ctx context.Context, sink streamSink) *streamFailure {
+		<-ctx.Done()
+		return nil
+	})
+	waitFor(t, func() bool { return activeStreams() == 0 })
+}
+
+// 关闭续传时客户端断开即结束生成，名额随之归还
+func TestStreamSlotReleasedWithoutResume(t *testing.T) {
+	useStreamConfig(t, StreamConfig{MaxPerKey: 1})
+
+	serveDetachedStream(t, &APIKey{ID: "k"}, func(ctx context.Context, sink streamSink) *streamFailure {
+		<-ctx.Done()
+		return nil
+	})
+	if activeStreams() != 0 {
+		t.Fatalf("active streams = %d after the handler returned", activeStreams())
+	}
+}
+
+// 退出时等待客户端断开后仍在生成的流，审计记录在关闭审计日志前恰好写入一次
+func TestShutdownWaitsForDetachedStreams(t *testing.T) {
+	useStreamConfig(t, StreamConfig{ResumeWindow: Duration(time.Minute), ResumeGrace: Duration(time.Minute)})
+	records := useAuditLog(t, "omit")
+	copied := *config
+	copied.ShutdownTimeout = Duration(20 * time.Millisecond)
+	config = &copied
+
+	savedCtx, savedDetached := serverCtx, detachedStreams
+	ctx, cancelRequests := context.WithCancelCause(context.Background())
+	serverCtx, detachedStreams = ctx, &sync.WaitGroup{}
+	t.Cleanup(func() { serverCtx, detachedStreams = savedCtx, savedDetached })
+
+	key := &APIKey{ID: "k"}
+	entry := newAuditEntry("req", "chat", key, httptest.NewRequest(http.MethodPost, "/", nil))
+	serveDetachedStream(t, key, entry.wrapStream(func(ctx context.Context, sink streamSink) *streamFailure {
+		<-ctx.Done()
+		return &streamFailure{status: http.StatusServiceUnavailable, message: "shutting down", code: "server_shutdown"}
+	}))
+
+	if err := shutdownServer(&http.Server{}, cancelRequests); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Close() // 与 startServer 中的顺序一致：shutdownServer 返回后才关闭审计日志
+	got := records()
+	if len(got) != 1 || got[0].Status != http.StatusServiceUnavailable {
+		t.Fatalf("audit records = %+v, want exactly one 503 line", got)
+	}
+	if activeStreams() != 0 {
+		t.Fatalf("active streams = %d after shutdown", activeStreams())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// 重试相关计数，通过 /debug/vars 暴露
+var (
+	upstreamAttempts  = expvar.NewInt("upstream_attempts")
+	upstreamRetries   = expvar.NewInt("upstream_retries")
+	upstreamFallbacks = expvar.NewInt("upstream_fallbacks")
+	upstreamExhausted = expvar.NewInt("upstream_retries_exhausted")
+)
+
+// 连接失败或读取上游流失败
+var errUpstreamRequest = errors.New("API request failed")
+
+// 判断上游错误是否值得对同一模型重试
+func isRetryableUpstreamError(err error) bool {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var streamErr *upstreamStreamError
+	if errors.As(err, &streamErr) {
+		return true
+	}
+	return errors.Is(err, errUpstreamRequest) || errors.Is(err, errEmptyAnswer)
+}
+
+// 第attempt次重试前的等待时间：指数退避并带抖动，范围为 [delay/2, delay]
+func retryBackoff(cfg RetryConfig, attempt int) time.Duration {
+	delay := time.Duration(cfg.BaseDelay)
+	for i := 1; i < attempt && delay < time.Duration(cfg.MaxDelay); i++ {
+		delay *= 2
+	}
+	delay = min(delay, time.Duration(cfg.MaxDelay))
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// 对单个模型发起请求，按配置重试可恢复的错误
+// 成功时返回的流已预读到第一个非空文本片段
+func requestModelWithRetry(ctx context.Context, params ChatProcessParams, cfg RetryConfig) (*kbChatStream, error) {
+	var lastErr error
+	for attempt := 1; attempt <= cfg.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			upstreamRetries.Add(1)
+		}
+		upstreamAttempts.Add(1)
+
+		attemptParams := params
+		if attemptParams.AssistantID == "" {
+			attemptParams.AssistantID = assistantPool.Next()
+		}
+
+		var stream *kbChatStream
+		resp, err := processChatRequest(ctx, attemptParams)
+		if err == nil {
+			stream = newKBChatStream(resp.Body)
+			if err = stream.peek(); err != nil {
+				stream.Close()
+			}
+		}
+		if err == nil || isAssistantFailure(err) {
+			assistantPool.Report(ctx, attemptParams.AssistantID, err)
+		}
+		if err == nil {
+			if attempt > 1 {
+				slog.InfoContext(ctx, "upstream succeeded after retries", "model", params.Model, "attempts", attempt)
+			}
+			return stream, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil || !isRetryableUpstreamError(err) || attempt == cfg.MaxAttempts {
+			break
+		}
+
+		delay := retryBackoff(cfg, attempt)
+		slog.WarnContext(ctx, "upstream attempt failed, retrying", "model", params.Model,
+			"attempt", attempt, "max_attempts", cfg.MaxAttempts, "delay", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return nil, lastErr
+}
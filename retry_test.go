@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := RetryConfig{BaseDelay: Duration(100 * time.Millisecond), MaxDelay: Duration(time.Second)}
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // 封顶
+		{50, time.Second},
+	} {
+		seen := map[time.Duration]bool{}
+		for range 200 {
+			d := retryBackoff(cfg, tc.attempt)
+			if d < tc.max/2 || d > tc.max {
+				t.Fatalf("attempt %d: delay %s outside [%s, %s]", tc.attempt, d, tc.max/2, tc.max)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("attempt %d: no jitter, always %v", tc.attempt, seen)
+		}
+	}
+
+	if d := retryBackoff(RetryConfig{}, 3); d != 0 {
+		t.Fatalf("zero config delay = %s", d)
+	}
+}
+
+func TestIsRetryableUpstreamError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&upstreamStatusError{StatusCode: 500}, true},
+		{&upstreamStatusError{StatusCode: 503}, true},
+		{&upstreamStatusError{StatusCode: 429}, true},
+		{&upstreamStatusError{StatusCode: 400}, false},
+		{&upstreamStatusError{StatusCode: 401}, false},
+		{&upstreamStatusError{StatusCode: 404}, false},
+		{&upstreamStreamError{Message: "boom"}, true},
+		{fmt.Errorf("%w: connection refused", errUpstreamRequest), true},
+		{errEmptyAnswer, true},
+		{fmt.Errorf("wrapped: %w", errEmptyAnswer), true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errQueueFull, false},
+		{errors.New("auth failed"), false},
+	} {
+		if got := isRetryableUpstreamError(tc.err); got != tc.want {
+			t.Errorf("isRetryableUpstreamError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{&upstreamStatusError{StatusCode: 500}, http.StatusBadGateway},
+		{&upstreamStatusError{StatusCode: 503}, http.StatusBadGateway},
+		{&upstreamStatusError{StatusCode: 401}, http.StatusBadGateway},
+		{&upstreamStatusError{StatusCode: 400}, http.StatusBadGateway},
+		{&upstreamStreamError{Message: "boom"}, http.StatusBadGateway},
+		{errEmptyAnswer, http.StatusBadGateway},
+		{errQueueFull, http.StatusServiceUnavailable},
+		{errQueueTimeout, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{&hookRejection{Status: 451}, 451},
+	} {
+		if got := upstreamErrorStatus(tc.err); got != tc.want {
+			t.Errorf("upstreamErrorStatus(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+// 可恢复的错误对同一模型重试，不可恢复的立即返回
+func TestRequestModelWithRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		responses []int // 依次返回的状态码，0表示返回回答，-1表示返回空回答
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", []int{0}, 1, false},
+		{"5xx then success", []int{500, 0}, 2, false},
+		{"429 then success", []int{429, 0}, 2, false},
+		{"empty then success", []int{-1, 0}, 2, false},
+		{"5xx exhausted", []int{503, 503, 503}, 3, true},
+		{"4xx not retried", []int{400, 0}, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(calls.Add(1)) - 1
+				switch status := tc.responses[min(n, len(tc.responses)-1)]; status {
+				case 0:
+					writeKBChatAnswer(w, "ok")
+				case -1:
+					writeKBChatAnswer(w)
+				default:
+					w.WriteHeader(status)
+				}
+			})
+
+			stream, err := requestModelWithRetry(context.Background(), ChatProcessParams{Model: "qwen", Prompt: "hi"},
+				RetryConfig{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)})
+			if got := int(calls.Load()); got != tc.wantCalls {
+				t.Fatalf("upstream called %d times, want %d", got, tc.wantCalls)
+			}
+			if tc.wantErr {
+				if err == nil {
+					stream.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text := readStream(t, stream); text != "ok" {
+				t.Fatalf("text = %q", text)
+			}
+		})
+	}
+}
+
+// 重试时每次从助手池取下一个assistantId
+func TestRequestModelWithRetryRotatesAssistants(t *testing.T) {
+	saved := assistantPool
+	assistantPool = NewAssistantPool([]string{"a", "b"}, 100, time.Minute)
+	t.Cleanup(func() { assistantPool = saved })
+
+	var assistants []string
+	useUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		assistants = append(assistants, r.URL.Query().Get("assistantId"))
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	requestModelWithRetry(context.Background(), ChatProcessParams{Model: "qwen", Prompt: "hi"},
+		RetryConfig{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)})
+	if !slices.Equal(assistants, []string{"a", "b", "a"}) {
+		t.Fatalf("assistantIds = %v", assistants)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// 服务关闭时用于取消剩余请求的原因
+var errServerShutdown = errors.New("server is shutting down")
+
+// 请求是否因服务关闭而被取消
+func isShuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errServerShutdown)
+}
+
+func startServer(port int, debug bool) error {
+	if err := setupLogging(config.Log, debug); err != nil {
+		return err
+	}
+	// 设置全局调试模式：--debug 或日志级别为 debug
+	debugMode = slog.Default().Enabled(context.Background(), slog.LevelDebug)
+
+	// 收到 SIGINT/SIGTERM 时开始优雅关闭
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// 所有上游请求共享同一个连接池
+	client, err := newUpstreamClient(config.Upstream)
+	if err != nil {
+		return fmt.Errorf("初始化上游HTTP客户端失败: %v", err)
+	}
+	upstreamClient = client
+
+	// 按配置选择token存储，后台在token过期前主动刷新
+	store, err := newTokenStore(config.TokenStore, config.StateDir)
+	if err != nil {
+		return fmt.Errorf("初始化token存储失败: %v", err)
+	}
+	tokenManager = NewTokenManager(store, loginUpstream)
+	go tokenManager.Run(ctx)
+
+	// 校验客户端API key；allow_anonymous 时接受任意key
+	if !config.Auth.AllowAnonymous {
+		keys, err := newKeyStore(config.Auth, config.StateDir)
+		if err != nil {
+			return fmt.Errorf("加载客户端密钥失败: %v", err)
+		}
+		if keys.Len() == 0 {
+			slog.Warn("密钥文件中没有任何key，所有 /v1 请求都会被拒绝；使用 `ullm keys create` 创建", "path", keys.path)
+		}
+		keyStore = keys
+	}
+
+	rateLimiter = NewRateLimiter(config.RateLimits)
+	upstreamLimiter = NewUpstreamLimiter(config.Concurrency)
+	streamTracker = NewStreamTracker(config.Stream)
+
+	// 审计日志：每个请求一行JSON，退出时关闭文件
+	if config.Audit.Enabled {
+		audit, err := NewAuditLog(config.Audit, config.StateDir)
+		if err != nil {
+			return fmt.Errorf("打开审计日志失败: %v", err)
+		}
+		auditLog = audit
+		defer audit.Close()
+	}
+
+	// 每个key的token额度计数，定期写入状态目录，退出时再保存一次
+	quotas, err := NewQuotaTracker(config.Quotas, config.StateDir)
+	if err != nil {
+		return fmt.Errorf("加载用量计数失败: %v", err)
+	}
+	quotaTracker = quotas
+	go quotaTracker.Run(ctx)
+	defer func() {
+		if err := quotaTracker.Flush(); err != nil {
+			slog.Warn("保存用量计数失败", "err", err)
+		}
+	}()
+
+	hooks, err := newHookChain(config.Hooks)
+	if err != nil {
+		return fmt.Errorf("初始化钩子失败: %v", err)
+	}
+	pipelineHooks = hooks
+
+	if config.AdminToken == "" {
+		slog.Warn("未设置 admin_token，/admin/*、/metrics 和 /debug/vars 对所有本机请求开放；同机部署反向代理时，经代理转发的外部请求同样可以访问")
+	}
+
+	assistantPool = NewAssistantPool(config.Assistants.IDs, config.Assistants.FailureThreshold, time.Duration(config.Assistants.Cooldown))
+
+	// 注册带日志中间件的路由
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", logMiddleware(apiKeyMiddleware(handleChatCompletions)))
+	mux.HandleFunc("/v1/models", logMiddleware(apiKeyMiddleware(handleModels)))
+	mux.HandleFunc("/v1/chat/history", logMiddleware(apiKeyMiddleware(handleOpenAIHistory)))
+	mux.HandleFunc("/v1/responses", logMiddleware(apiKeyMiddleware(handleResponses)))
+	mux.HandleFunc("/v1/completions", logMiddleware(apiKeyMiddleware(handleCompletions)))
+	mux.HandleFunc("/admin/assistants", logMiddleware(adminMiddleware(handleAdminAssistants)))
+	mux.HandleFunc("/admin/streams", logMiddleware(adminMiddleware(handleAdminStreams)))
+	mux.HandleFunc("/debug/vars", adminMiddleware(expvar.Handler().ServeHTTP))
+	mux.HandleFunc("/metrics", adminMiddleware(handleMetrics))
+
+	// 处理404情况
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if debugMode {
+			slog.DebugContext(r.Context(), "404 Not Found", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "headers", redactHeaders(r.Header))
+		} else {
+			slog.InfoContext(r.Context(), "received request", "method", r.Method, "path", r.URL.Path)
+		}
+		http.NotFound(w, r)
+	})
+
+	// 所有请求的context都派生自baseCtx，关闭超时后取消它以中断剩余的流
+	baseCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(nil)
+	serverCtx = baseCtx
+
+	addr := fmt.Sprintf(":%d", port)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           requestIDMiddleware(mux),
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	fmt.Printf("服务器启动在 http://0.0.0.0%s\n", addr)
+	fmt.Printf("可用接口:\n")
+	fmt.Printf("  POST http://0.0.0.0%s/v1/chat/completions - 聊天完成\n", addr)
+	fmt.Printf("  POST http://0.0.0.0%s/v1/responses - OpenAI统一响应接口\n", addr)
+	fmt.Printf("  POST http://0.0.0.0%s/v1/completions - 文本补全\n", addr)
+	fmt.Printf("  GET  http://0.0.0.0%s/v1/models - 模型列表\n", addr)
+	fmt.Printf("  GET  http://0.0.0.0%s/v1/chat/history - OpenAI格式历史记录\n", addr)
+	fmt.Printf("  GET  http://0.0.0.0%s/admin/assistants - assistantId健康状态\n", addr)
+	fmt.Printf("  GET  http://0.0.0.0%s/admin/streams - 各key打开的流式连接\n", addr)
+	fmt.Printf("  GET  http://0.0.0.0%s/metrics - Prometheus指标\n", addr)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	return shutdownServer(server, cancelRequests)
+}
+
+// shutdownServer 停止接受新请求并等待进行中的请求和客户端断开后仍在进行的生成完成；
+// 超过 shutdown_timeout 后取消剩余请求，让流式响应发送最后的错误事件后退出。
+// 返回后才关闭审计日志和保存用量，因此每个生成都能写入自己的记录
+func shutdownServer(server *http.Server, cancelRequests context.CancelCauseFunc) error {
+	timeout := time.Duration(config.ShutdownTimeout)
+	slog.Info("收到退出信号，停止接受新请求，等待进行中的请求完成", "timeout", timeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(drainCtx)
+	if err == nil {
+		err = waitDetachedStreams(drainCtx)
+	}
+	if err == nil {
+		slog.Info("所有请求已完成，服务器已退出")
+		return nil
+	}
+
+	// 通知剩余的请求结束，并给它们一点时间写出错误事件
+	slog.Warn("等待超时，中断剩余请求")
+	cancelRequests(errServerShutdown)
+
+	finalCtx, cancelFinal := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFinal()
+	var closeErr error
+	if err := server.Shutdown(finalCtx); err != nil {
+		slog.Warn("强制关闭剩余连接", "err", err)
+		closeErr = server.Close()
+	}
+	if err := waitDetachedStreams(finalCtx); err != nil {
+		slog.Warn("后台生成未能及时结束，其审计记录和用量可能丢失", "err", err)
+	}
+	if closeErr == nil {
+		slog.Info("服务器已退出")
+	}
+	return closeErr
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// slotWaiter 排队等待名额的一个请求，value 由使用者携带（如等待中的流）
+type slotWaiter[T any] struct {
+	value   T
+	ready   chan struct{}
+	granted bool
+}
+
+// slotQueue 先进先出的名额等待队列，被 UpstreamLimiter 和 StreamTracker 共用。
+// 队列本身不加锁，由使用者的锁保护；名额的计数也由使用者维护，队列只负责顺序和交接
+type slotQueue[T any] struct {
+	waiters []*slotWaiter[T]
+}
+
+func (q *slotQueue[T]) Len() int {
+	return len(q.waiters)
+}
+
+// Enqueue 排到队尾，返回的等待者交给 Wait
+func (q *slotQueue[T]) Enqueue(value T) *slotWaiter[T] {
+	w := &slotWaiter[T]{value: value, ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	return w
+}
+
+// GrantNext 把名额交给最早的等待者并唤醒它，队列为空时返回nil
+func (q *slotQueue[T]) GrantNext() *slotWaiter[T] {
+	if len(q.waiters) == 0 {
+		return nil
+	}
+	w := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	w.granted = true
+	close(w.ready)
+	return w
+}
+
+// Remove 移除放弃等待且尚未被授予名额的请求
+func (q *slotQueue[T]) Remove(w *slotWaiter[T]) {
+	q.waiters = slices.DeleteFunc(q.waiters, func(other *slotWaiter[T]) bool { return other == w })
+}
+
+// Wait 在不持有mu时等待名额，直到被唤醒、ctx结束或超过timeout（0表示不限制）。
+// 放弃等待时在mu内调用abandon：granted为true表示放弃的同时刚好轮到，名额已记在自己名下，
+// 需要让给下一个；否则只需把自己移出队列
+func (w *slotWaiter[T]) Wait(ctx context.Context, mu sync.Locker, timeout time.Duration, errTimeout error, abandon func(granted bool)) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = errTimeout
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	abandon(w.granted)
+	return err
+}
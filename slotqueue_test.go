@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestSlotTimeout = errors.New("slot timeout")
+
+func TestSlotQueueFIFO(t *testing.T) {
+	var q slotQueue[int]
+	waiters := []*slotWaiter[int]{q.Enqueue(1), q.Enqueue(2), q.Enqueue(3)}
+	q.Remove(waiters[1])
+	if q.Len() != 2 {
+		t.Fatalf("len = %d", q.Len())
+	}
+	for _, want := range []int{1, 3} {
+		w := q.GrantNext()
+		if w == nil || w.value != want || !w.granted {
+			t.Fatalf("granted %+v, want %d", w, want)
+		}
+		select {
+		case <-w.ready:
+		default:
+			t.Fatalf("waiter %d not woken", want)
+		}
+	}
+	if q.GrantNext() != nil {
+		t.Fatal("empty queue granted a slot")
+	}
+}
+
+// 放弃等待时按是否已被授予名额分别交还名额或移出队列
+func TestSlotWaiterAbandon(t *testing.T) {
+	var mu sync.Mutex
+	var q slotQueue[struct{}]
+
+	// 超时：仍在队列中，只需移出
+	w := q.Enqueue(struct{}{})
+	var abandoned []bool
+	err := w.Wait(context.Background(), &mu, 10*time.Millisecond, errTestSlotTimeout, func(granted bool) {
+		abandoned = append(abandoned, granted)
+		q.Remove(w)
+	})
+	if err != errTestSlotTimeout || len(abandoned) != 1 || abandoned[0] || q.Len() != 0 {
+		t.Fatalf("err = %v, abandoned = %v, len = %d", err, abandoned, q.Len())
+	}
+
+	// 取消的同时被授予名额：abandon 收到 granted=true，由调用方把名额让给下一个
+	ctx, cancel := context.WithCancel(context.Background())
+	w = q.Enqueue(struct{}{})
+	mu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Wait(ctx, &mu, 0, errTestSlotTimeout, func(granted bool) { abandoned = append(abandoned, granted) })
+	}()
+	cancel()
+	time.Sleep(20 * time.Millisecond) // 等待者停在加锁处
+	q.GrantNext()
+	mu.Unlock()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	if len(abandoned) != 2 || !abandoned[1] {
+		t.Fatalf("abandoned = %v, want the granted slot handed back", abandoned)
+	}
+
+	// 正常轮到时不调用 abandon
+	w = q.Enqueue(struct{}{})
+	mu.Lock()
+	q.GrantNext()
+	mu.Unlock()
+	if err := w.Wait(context.Background(), &mu, 0, errTestSlotTimeout, func(bool) { t.Fatal("abandon called") }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 流式连接排队同样先进先出，放弃等待时刚好轮到的名额让给下一个
+func TestStreamTrackerQueue(t *testing.T) {
+	useStreamConfig(t, StreamConfig{MaxPerKey: 1, Overflow: "queue"})
+	key := &APIKey{ID: "k"}
+	holder := &activeStream{RequestID: "holder"}
+	if _, err := streamTracker.Acquire(context.Background(), key, holder); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := streamTracker.Acquire(ctx, key, &activeStream{RequestID: "first"})
+		first <- err
+	}()
+	waitFor(t, func() bool { return streamTracker.Snapshot()[0].Queued == 1 })
+	second := make(chan func(), 1)
+	go func() {
+		release, _ := streamTracker.Acquire(context.Background(), key, &activeStream{RequestID: "second"})
+		second <- release
+	}()
+	waitFor(t, func() bool { return streamTracker.Snapshot()[0].Queued == 2 })
+
+	// 持锁期间取消第一个等待者，使其停在加锁处；随后在同一把锁内结束holder并把名额交给它
+	streamTracker.mu.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	streamTracker.removeLocked(key.ID, 1, holder)
+	streamTracker.mu.Unlock()
+
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first waiter: err = %v", err)
+	}
+	var next func()
+	select {
+	case next = <-second:
+	case <-time.After(time.Second):
+		t.Fatal("slot was not handed over to the second waiter")
+	}
+	if snapshot := streamTracker.Snapshot(); len(snapshot) != 1 || snapshot[0].Active != 1 || snapshot[0].Queued != 0 || snapshot[0].Streams[0].RequestID != "second" {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+	next()
+	if activeStreams() != 0 {
+		t.Fatalf("active streams = %d", activeStreams())
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 单个SSE事件允许的最大字节数，防止异常上游耗尽内存
+const sseMaxEventSize = 16 << 20
+
+var errSSEEventTooLarge = errors.New("sse event exceeds size limit")
+
+// sseEvent 一个完整的SSE事件
+type sseEvent struct {
+	Event string // 事件类型，未指定时为空
+	ID    string // 最近一次出现的 id 字段
+	Data  string // 多行 data 以 "\n" 连接
+}
+
+// sseReader 按 WHATWG Server-Sent Events 规范解析事件流：
+// 支持 CRLF/LF/CR 换行、多行 data、event/id 字段、注释行和任意长度的行
+type sseReader struct {
+	r       *bufio.Reader
+	lastID  string
+	skipLF  bool // 上一行以CR结尾，若紧跟LF需跳过
+	started bool // 是否已处理开头的BOM
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReader(r)}
+}
+
+// Next 返回下一个事件，流结束时返回 io.EOF。
+// 与规范不同，流末尾缺少空行的最后一个事件仍会被返回，以兼容不规范的上游
+func (s *sseReader) Next() (*sseEvent, error) {
+	var eventType string
+	var data strings.Builder
+	hasData := false
+	size := 0
+
+	for {
+		line, err := s.readLine()
+		if err == io.EOF && hasData {
+			return s.dispatch(eventType, &data), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// 空行：分发事件
+		if line == "" {
+			if hasData {
+				return s.dispatch(eventType, &data), nil
+			}
+			eventType = ""
+			continue
+		}
+
+		// 注释行（常用于心跳）
+		if line[0] == ':' {
+			continue
+		}
+
+		size += len(line)
+		if size > sseMaxEventSize {
+			return nil, errSSEEventTooLarge
+		}
+
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				s.lastID = value
+			}
+		}
+		// retry 及未知字段按规范忽略
+	}
+}
+
+func (s *sseReader) dispatch(eventType string, data *strings.Builder) *sseEvent {
+	return &sseEvent{Event: eventType, ID: s.lastID, Data: data.String()}
+}
+
+// UTF-8 BOM，流开头出现时跳过
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// readLine 读取一行（不含换行符），换行可以是 CRLF、LF 或单独的 CR
+func (s *sseReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := s.r.Peek(max(s.r.Buffered(), 1))
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return string(line), nil
+			}
+			return "", err
+		}
+
+		if s.skipLF {
+			s.skipLF = false
+			if chunk[0] == '\n' {
+				s.r.Discard(1)
+				continue
+			}
+		}
+		if !s.started {
+			s.started = true
+			if bom, err := s.r.Peek(len(utf8BOM)); err == nil && bytes.Equal(bom, utf8BOM) {
+				s.r.Discard(len(utf8BOM))
+				continue
+			}
+		}
+
+		n := bytes.IndexAny(chunk, "\r\n")
+		if n < 0 {
+			n = len(chunk)
+		}
+		if len(line)+n > sseMaxEventSize {
+			return "", errSSEEventTooLarge
+		}
+		line = append(line, chunk[:n]...)
+		if n == len(chunk) {
+			s.r.Discard(n)
+			continue
+		}
+
+		s.skipLF = chunk[n] == '\r'
+		s.r.Discard(n + 1)
+		return string(line), nil
+	}
+}
+
+// 上游在流中返回了错误事件
+type upstreamStreamError struct {
+	Message string
+}
+
+func (e *upstreamStreamError) Error() string {
+	return fmt.Sprintf("upstream stream error: %s", e.Message)
+}
+
+// kbChat 流中单个事件的JSON载荷
+type kbChatPayload struct {
+	Data    string          `json:"data"`
+	Code    *int            `json:"code"`
+	Message string          `json:"message"`
+	Msg     string          `json:"msg"`
+	Error   json.RawMessage `json:"error"`
+}
+
+// parseKBChatEvent 解析kbChat事件，返回文本片段以及流是否结束
+func parseKBChatEvent(ev *sseEvent) (string, bool, error) {
+	switch ev.Event {
+	case "error":
+		return "", false, &upstreamStreamError{Message: ev.Data}
+	case "end", "done", "finish", "close":
+		return "", true, nil
+	}
+
+	if strings.TrimSpace(ev.Data) == "[DONE]" {
+		return "", true, nil
+	}
+
+	var payload kbChatPayload
+	if err := json.Unmarshal([]byte(ev.Data), &payload); err != nil {
+		// 非JSON数据不是回答内容，忽略
+		return "", false, nil
+	}
+
+	if len(payload.Error) > 0 && string(payload.Error) != "null" && string(payload.Error) != `""` {
+		return "", false, &upstreamStreamError{Message: string(payload.Error)}
+	}
+	if payload.Code != nil && *payload.Code != 0 && *payload.Code != 200 && payload.Data == "" {
+		message := payload.Message
+		if message == "" {
+			message = payload.Msg
+		}
+		return "", false, &upstreamStreamError{Message: fmt.Sprintf("code=%d %s", *payload.Code, message)}
+	}
+	return payload.Data, false, nil
+}
+
+// kbChatStream 按顺序返回上游回答的文本片段
+type kbChatStream struct {
+	body   io.ReadCloser
+	events *sseReader
+	peeked *string // peek 预读的第一个片段
+	done   bool
+}
+
+func newKBChatStream(body io.ReadCloser) *kbChatStream {
+	return &kbChatStream{body: body, events: newSSEReader(body)}
+}
+
+// Next 返回下一个非空文本片段，回答结束时返回 io.EOF
+func (s *kbChatStream) Next() (string, error) {
+	if s.peeked != nil {
+		text := *s.peeked
+		s.peeked = nil
+		return text, nil
+	}
+	if s.done {
+		return "", io.EOF
+	}
+
+	for {
+		ev, err := s.events.Next()
+		if err == io.EOF {
+			s.done = true
+			return "", io.EOF
+		}
+		if errors.Is(err, errSSEEventTooLarge) {
+			return "", err
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: failed to read response stream: %w", errUpstreamRequest, err)
+		}
+
+		text, done, err := parseKBChatEvent(ev)
+		if err != nil {
+			return "", err
+		}
+		if done {
+			s.done = true
+			return "", io.EOF
+		}
+		if text != "" {
+			return text, nil
+		}
+	}
+}
+
+// peek 预读第一个非空片段，此时尚未向客户端写出任何内容；流中没有内容时返回 errEmptyAnswer
+func (s *kbChatStream) peek() error {
+	text, err := s.Next()
+	if err == io.EOF {
+		return errEmptyAnswer
+	}
+	if err != nil {
+		return err
+	}
+	s.peeked = &text
+	return nil
+}
+
+func (s *kbChatStream) Close() error {
+	return s.body.Close()
+}
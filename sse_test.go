@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readAllEvents 读取流中的全部事件，返回遇到的第一个非EOF错误
+func readAllEvents(r io.Reader) ([]sseEvent, error) {
+	reader := newSSEReader(r)
+	var events []sseEvent
+	for {
+		ev, err := reader.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, *ev)
+	}
+}
+
+func TestSSEReader(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []sseEvent
+	}{
+		{
+			name:  "lf",
+			input: "data: a\n\ndata: b\n\n",
+			want:  []sseEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:  "crlf",
+			input: "data: a\r\n\r\ndata: b\r\n\r\n",
+			want:  []sseEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:  "lone cr",
+			input: "data: a\r\rdata: b\r\r",
+			want:  []sseEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:  "mixed line endings",
+			input: "event: x\rdata: a\r\n\ndata: b\n\r",
+			want:  []sseEvent{{Event: "x", Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:  "bom",
+			input: "\xEF\xBB\xBFdata: a\n\n",
+			want:  []sseEvent{{Data: "a"}},
+		},
+		{
+			name:  "bom only at start",
+			input: "data: a\n\ndata: \xEF\xBB\xBFb\n\n",
+			want:  []sseEvent{{Data: "a"}, {Data: "\xEF\xBB\xBFb"}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: line1\ndata:line2\ndata\ndata:  indented\n\n",
+			want:  []sseEvent{{Data: "line1\nline2\n\n indented"}},
+		},
+		{
+			name:  "event type resets after dispatch",
+			input: "event: error\ndata: boom\n\ndata: ok\n\n",
+			want:  []sseEvent{{Event: "error", Data: "boom"}, {Data: "ok"}},
+		},
+		{
+			name:  "id persists across events",
+			input: "id: 1\ndata: a\n\ndata: b\n\nid: 2\ndata: c\n\n",
+			want:  []sseEvent{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}, {ID: "2", Data: "c"}},
+		},
+		{
+			name:  "id with nul ignored",
+			input: "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n",
+			want:  []sseEvent{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}},
+		},
+		{
+			name:  "comments and unknown fields",
+			input: ": ping\nretry: 100\nfoo: bar\ndata: a\n\n:\n\n",
+			want:  []sseEvent{{Data: "a"}},
+		},
+		{
+			name:  "event without data is not dispatched",
+			input: "event: end\n\ndata: a\n\n",
+			want:  []sseEvent{{Data: "a"}},
+		},
+		{
+			name:  "last event without trailing blank line",
+			input: "data: a\n\ndata: b",
+			want:  []sseEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readAllEvents(strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d events %q, want %d %q", len(got), got, len(tc.want), tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("event %d = %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// 超过 sseMaxEventSize 的事件返回 errSSEEventTooLarge，而不是无限制地占用内存
+func TestSSEReaderEventTooLarge(t *testing.T) {
+	t.Run("single line", func(t *testing.T) {
+		input := "data: " + strings.Repeat("a", sseMaxEventSize) + "\n\n"
+		if _, err := readAllEvents(strings.NewReader(input)); !errors.Is(err, errSSEEventTooLarge) {
+			t.Fatalf("err = %v, want errSSEEventTooLarge", err)
+		}
+	})
+	t.Run("many data lines", func(t *testing.T) {
+		line := "data: " + strings.Repeat("a", 1<<20) + "\n"
+		input := strings.Repeat(line, sseMaxEventSize>>20+1) + "\n"
+		if _, err := readAllEvents(strings.NewReader(input)); !errors.Is(err, errSSEEventTooLarge) {
+			t.Fatalf("err = %v, want errSSEEventTooLarge", err)
+		}
+	})
+	t.Run("just under the limit", func(t *testing.T) {
+		input := "data:" + strings.Repeat("a", sseMaxEventSize-len("data:")) + "\n\n"
+		events, err := readAllEvents(strings.NewReader(input))
+		if err != nil || len(events) != 1 || len(events[0].Data) != sseMaxEventSize-len("data:") {
+			t.Fatalf("got %d events, err %v", len(events), err)
+		}
+	})
+}
+
+// 把所有换行统一为LF后解析结果应不变
+func normalizeNewlines(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+}
+
+func FuzzSSEReader(f *testing.F) {
+	for _, seed := range []string{
+		"data: a\n\n",
+		"data: a\r\n\r\n",
+		"data: a\r\rdata: b\r",
+		"\xEF\xBB\xBFdata: a\n\n",
+		"\xEF\xBBdata: a\n\n",
+		"event: error\ndata: {\"code\":500}\n\n",
+		"id: 1\ndata: a\ndata: b\n\n: ping\n\n",
+		"data: {\"data\":\"hi\"}\n\nevent: end\ndata: \n\n",
+		"data",
+		"\r\n\r",
+		":\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		events, err := readAllEvents(bytes.NewReader(data))
+		for _, ev := range events {
+			if strings.ContainsAny(ev.Event, "\r\n") || strings.ContainsAny(ev.ID, "\r\n\x00") || strings.Contains(ev.Data, "\r") {
+				t.Fatalf("line break leaked into event: %+v", ev)
+			}
+			if len(ev.Data) > sseMaxEventSize {
+				t.Fatalf("event data of %d bytes exceeds limit", len(ev.Data))
+			}
+		}
+		if err != nil && !errors.Is(err, errSSEEventTooLarge) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// CRLF、CR、LF 是等价的换行
+		normalized, normErr := readAllEvents(bytes.NewReader(normalizeNewlines(data)))
+		if (err == nil) != (normErr == nil) || len(events) != len(normalized) {
+			t.Fatalf("normalizing newlines changed result: %q (%v) vs %q (%v)", events, err, normalized, normErr)
+		}
+		for i := range events {
+			if events[i] != normalized[i] {
+				t.Fatalf("event %d: %+v vs %+v after normalizing newlines", i, events[i], normalized[i])
+			}
+		}
+	})
+}
+
+func TestParseKBChatEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ev       sseEvent
+		wantText string
+		wantDone bool
+		wantErr  string // 期望错误信息包含的内容，为空表示没有错误
+	}{
+		{name: "text", ev: sseEvent{Data: `{"data":"你好"}`}, wantText: "你好"},
+		{name: "empty text", ev: sseEvent{Data: `{"data":""}`}},
+		{name: "code 200 with text", ev: sseEvent{Data: `{"code":200,"data":"ok"}`}, wantText: "ok"},
+		{name: "code 0", ev: sseEvent{Data: `{"code":0,"data":"ok"}`}, wantText: "ok"},
+		{name: "error code with message", ev: sseEvent{Data: `{"code":500,"message":"internal"}`}, wantErr: "code=500 internal"},
+		{name: "error code with msg", ev: sseEvent{Data: `{"code":40001,"msg":"quota"}`}, wantErr: "code=40001 quota"},
+		{name: "error code without data is an error even without message", ev: sseEvent{Data: `{"code":429}`}, wantErr: "code=429"},
+		{name: "non-zero code with text is content", ev: sseEvent{Data: `{"code":1,"data":"text"}`}, wantText: "text"},
+		{name: "error field", ev: sseEvent{Data: `{"error":{"message":"bad"}}`}, wantErr: `"bad"`},
+		{name: "error string", ev: sseEvent{Data: `{"error":"bad"}`}, wantErr: `"bad"`},
+		{name: "null error", ev: sseEvent{Data: `{"error":null,"data":"ok"}`}, wantText: "ok"},
+		{name: "empty error", ev: sseEvent{Data: `{"error":"","data":"ok"}`}, wantText: "ok"},
+		{name: "error event", ev: sseEvent{Event: "error", Data: "upstream exploded"}, wantErr: "upstream exploded"},
+		{name: "end event", ev: sseEvent{Event: "end", Data: `{"data":"ignored"}`}, wantDone: true},
+		{name: "done event", ev: sseEvent{Event: "done"}, wantDone: true},
+		{name: "finish event", ev: sseEvent{Event: "finish"}, wantDone: true},
+		{name: "close event", ev: sseEvent{Event: "close"}, wantDone: true},
+		{name: "done marker", ev: sseEvent{Data: "[DONE]"}, wantDone: true},
+		{name: "done marker with spaces", ev: sseEvent{Data: " [DONE] "}, wantDone: true},
+		{name: "non-json ignored", ev: sseEvent{Data: "hello"}},
+		{name: "unknown event type is parsed", ev: sseEvent{Event: "message", Data: `{"data":"x"}`}, wantText: "x"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			text, done, err := parseKBChatEvent(&tc.ev)
+			if tc.wantErr != "" {
+				var streamErr *upstreamStreamError
+				if !errors.As(err, &streamErr) || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v, want upstreamStreamError containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if text != tc.wantText || done != tc.wantDone {
+				t.Fatalf("got (%q, %v), want (%q, %v)", text, done, tc.wantText, tc.wantDone)
+			}
+		})
+	}
+}
+
+// 按 runPipeline 的方式逐段读取，直到EOF或出错
+func drainKBChatStream(s *kbChatStream) (string, error) {
+	var text strings.Builder
+	for {
+		chunk, err := s.Next()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return text.String(), err
+		}
+		text.WriteString(chunk)
+	}
+}
+
+func TestKBChatStream(t *testing.T) {
+	body := "data: {\"data\":\"\"}\n\ndata: {\"data\":\"he\"}\n\n: ping\n\ndata: {\"data\":\"llo\"}\n\nevent: end\ndata: {}\n\ndata: {\"data\":\"after end\"}\n\n"
+	s := newKBChatStream(io.NopCloser(strings.NewReader(body)))
+	if err := s.peek(); err != nil {
+		t.Fatal(err)
+	}
+	text, err := drainKBChatStream(s)
+	if err != nil || text != "hello" {
+		t.Fatalf("Next = (%q, %v), want (hello, nil)", text, err)
+	}
+
+	empty := newKBChatStream(io.NopCloser(strings.NewReader("data: {\"data\":\"\"}\n\n[DONE]\n\n")))
+	if err := empty.peek(); !errors.Is(err, errEmptyAnswer) {
+		t.Fatalf("peek on empty answer = %v, want errEmptyAnswer", err)
+	}
+
+	failing := newKBChatStream(io.NopCloser(strings.NewReader("data: {\"data\":\"partial\"}\n\nevent: error\ndata: boom\n\n")))
+	text, err = drainKBChatStream(failing)
+	var streamErr *upstreamStreamError
+	if text != "partial" || !errors.As(err, &streamErr) {
+		t.Fatalf("Next = (%q, %v), want partial text and upstreamStreamError", text, err)
+	}
+}
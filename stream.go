@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseWriter 向客户端写出SSE事件，可在等待上游期间由心跳goroutine并发写入注释行。
+// 响应头在第一次写入时才发出，此前出错仍可返回普通的HTTP错误
+type sseWriter struct {
+	w         http.ResponseWriter
+	flusher   http.Flusher
+	mu        sync.Mutex
+	started   bool
+	failed    bool // 已以普通HTTP错误结束，之后的写入被丢弃
+	lastWrite time.Time
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("Streaming unsupported")
+	}
+	return &sseWriter{w: w, flusher: flusher}, nil
+}
+
+// 发出SSE响应头，调用方需持有锁
+func (s *sseWriter) startLocked() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.w.Header().Set("X-Accel-Buffering", "no") // 禁止反向代理缓冲
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// 写出一段原始SSE文本并立即刷新，调用方需持有锁
+func (s *sseWriter) writeLocked(text string) {
+	if s.failed {
+		return
+	}
+	s.startLocked()
+	fmt.Fprint(s.w, text)
+	s.flusher.Flush()
+	s.lastWrite = time.Now()
+}
+
+// SetHeader 设置响应头，响应头已发出时忽略
+func (s *sseWriter) SetHeader(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.w.Header().Set(key, value)
+	}
+}
+
+// WriteData 将v编码为JSON并作为一个 data 事件写出
+func (s *sseWriter) WriteData(v any) {
+	data, _ := json.Marshal(v)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(fmt.Sprintf("data: %s\n\n", data))
+}
+
+// WriteEvent 写出带 id 的事件，客户端重连时通过 Last-Event-ID 回传
+func (s *sseWriter) WriteEvent(id, data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(fmt.Sprintf("id: %s\ndata: %s\n\n", id, data))
+}
+
+// WriteDone 写出OpenAI风格的结束标记
+func (s *sseWriter) WriteDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked("data: [DONE]\n\n")
+}
+
+// WriteError 流式响应中途失败时发送的错误事件，格式与OpenAI流中的错误一致
+func (s *sseWriter) WriteError(message, code string) {
+	s.WriteData(streamErrorPayload(message, code))
+}
+
+// 流中错误事件的负载
+func streamErrorPayload(message, code string) map[string]any {
+	return map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    "server_error",
+			"code":    code,
+		},
+	}
+}
+
+// StartHeartbeat 每隔interval检查一次，若期间没有写出任何内容则发送 ": ping" 注释，
+// 防止反向代理关闭空闲连接。OpenAI客户端会忽略注释行。返回的函数用于停止心跳
+func (s *sseWriter) StartHeartbeat(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			s.mu.Lock()
+			if time.Since(s.lastWrite) >= interval {
+				s.writeLocked(": ping\n\n")
+			}
+			s.mu.Unlock()
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// Fail 返回错误：流已开始时发送错误事件，否则返回普通HTTP错误。
+// 判断和写出都在锁内完成，心跳不会在两者之间发出响应头
+func (s *sseWriter) Fail(status int, message, code string) {
+	data, _ := json.Marshal(streamErrorPayload(message, code))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		s.writeLocked(fmt.Sprintf("data: %s\n\n", data))
+		return
+	}
+	s.started, s.failed = true, true
+	http.Error(s.w, message, status)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 心跳与 Fail 并发时，要么返回普通HTTP错误且之后不再写出心跳，要么以错误事件结束SSE流；
+// httptest.ResponseRecorder 不是并发安全的，配合 -race 可发现未加锁的写入
+func TestSSEWriterFailDuringHeartbeat(t *testing.T) {
+	for range 50 {
+		rec := httptest.NewRecorder()
+		sw, err := newSSEWriter(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := sw.StartHeartbeat(20 * time.Microsecond)
+		time.Sleep(time.Duration(time.Now().UnixNano()%40) * time.Microsecond)
+		sw.Fail(http.StatusServiceUnavailable, "upstream overloaded", "server_overloaded")
+		time.Sleep(50 * time.Microsecond)
+		stop()
+
+		body := rec.Body.String()
+		switch rec.Code {
+		case http.StatusServiceUnavailable:
+			if body != "upstream overloaded\n" {
+				t.Fatalf("plain error body = %q", body)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Fatalf("plain error Content-Type = %q", ct)
+			}
+		case http.StatusOK:
+			if !strings.HasPrefix(body, ": ping\n\n") || !strings.Contains(body, `"code":"server_overloaded"`) {
+				t.Fatalf("stream body = %q", body)
+			}
+		default:
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+func TestSSEWriterFailBeforeStart(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw, _ := newSSEWriter(rec)
+	sw.Fail(http.StatusBadGateway, "bad upstream", "upstream_error")
+	sw.WriteData(map[string]string{"ignored": "yes"})
+	sw.WriteDone()
+
+	if rec.Code != http.StatusBadGateway || rec.Body.String() != "bad upstream\n" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSSEWriterFailAfterStart(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw, _ := newSSEWriter(rec)
+	sw.SetHeader(ResolvedModelHeader, "m")
+	sw.WriteEvent("s:1", `{"x":1}`)
+	sw.SetHeader("X-Too-Late", "1")
+	sw.Fail(http.StatusBadGateway, "bad upstream", "upstream_error")
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get(ResolvedModelHeader) != "m" || rec.Header().Get("X-Too-Late") != "" {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+	want := "id: s:1\ndata: {\"x\":1}\n\n" +
+		`data: {"error":{"code":"upstream_error","message":"bad upstream","type":"server_error"}}` + "\n\n"
+	if rec.Body.String() != want {
+		t.Fatalf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
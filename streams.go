@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errStreamQueueTimeout = errors.New("timed out waiting for another stream of this key to finish")
+
+// streamLimitError key打开的流式连接已达上限
+type streamLimitError struct {
+	limit int
+}
+
+func (e *streamLimitError) Error() string {
+	return fmt.Sprintf("too many concurrent streams for this key: limit %d", e.limit)
+}
+
+// activeStream 一个打开中的流式连接
+type activeStream struct {
+	RequestID  string    `json:"request_id"`
+	API        string    `json:"api"`
+	Model      string    `json:"model"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// 一个key的流式连接
+type keyStreams struct {
+	name    string
+	active  []*activeStream
+	waiters slotQueue[*activeStream] // 等待同一key的其他流结束的请求
+}
+
+// StreamTracker 记录每个key打开的流式连接，超过上限时拒绝或排队
+type StreamTracker struct {
+	mu       sync.Mutex
+	def      int    // 未单独设置上限的key使用的上限，0表示不限制
+	overflow string // "reject" 或 "queue"
+	timeout  time.Duration
+	keys     map[string]*keyStreams
+}
+
+// 全局流式连接统计，startServer 按配置初始化
+var streamTracker = NewStreamTracker(StreamConfig{})
+
+func NewStreamTracker(cfg StreamConfig) *StreamTracker {
+	return &StreamTracker{
+		def:      cfg.MaxPerKey,
+		overflow: cfg.Overflow,
+		timeout:  time.Duration(cfg.QueueTimeout),
+		keys:     make(map[string]*keyStreams),
+	}
+}
+
+// 返回key的流式连接上限：key自己的设置优先
+func (t *StreamTracker) keyLimit(key *APIKey) int {
+	if key.Limits.Streams > 0 {
+		return key.Limits.Streams
+	}
+	return t.def
+}
+
+// Acquire 登记一个流式连接，返回的release在连接结束时调用。
+// 达到上限时按 overflow 配置立即返回 *streamLimitError，或排队等待该key的其他流结束
+func (t *StreamTracker) Acquire(ctx context.Context, key *APIKey, stream *activeStream) (func(), error) {
+	limit := t.keyLimit(key)
+
+	t.mu.Lock()
+	ks, ok := t.keys[key.ID]
+	if !ok {
+		ks = &keyStreams{}
+		t.keys[key.ID] = ks
+	}
+	ks.name = key.Name
+	if limit <= 0 || (len(ks.active) < limit && ks.waiters.Len() == 0) {
+		ks.active = append(ks.active, stream)
+		t.mu.Unlock()
+		return t.releaseFunc(key.ID, limit, stream), nil
+	}
+	if t.overflow != "queue" {
+		t.mu.Unlock()
+		return nil, &streamLimitError{limit: limit}
+	}
+
+	w := ks.waiters.Enqueue(stream)
+	t.mu.Unlock()
+
+	err := w.Wait(ctx, &t.mu, t.timeout, errStreamQueueTimeout, func(granted bool) {
+		if granted {
+			t.removeLocked(key.ID, limit, stream)
+			return
+		}
+		ks.waiters.Remove(w)
+		t.cleanupLocked(key.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.releaseFunc(key.ID, limit, stream), nil
+}
+
+func (t *StreamTracker) releaseFunc(keyID string, limit int, stream *activeStream) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.removeLocked(keyID, limit, stream)
+		})
+	}
+}
+
+// 移除一个连接，并按先后顺序唤醒等待的请求
+func (t *StreamTracker) removeLocked(keyID string, limit int, stream *activeStream) {
+	ks := t.keys[keyID]
+	ks.active = slices.DeleteFunc(ks.active, func(other *activeStream) bool { return other == stream })
+	for ks.waiters.Len() > 0 && (limit <= 0 || len(ks.active) < limit) {
+		ks.active = append(ks.active, ks.waiters.GrantNext().value)
+	}
+	t.cleanupLocked(keyID)
+}
+
+func (t *StreamTracker) cleanupLocked(keyID string) {
+	if ks := t.keys[keyID]; len(ks.active) == 0 && ks.waiters.Len() == 0 {
+		delete(t.keys, keyID)
+	}
+}
+
+// keyStreamsSnapshot 一个key的流式连接状态
+type keyStreamsSnapshot struct {
+	KeyID   string          `json:"key_id"`
+	Name    string          `json:"name"`
+	Active  int             `json:"active"`
+	Queued  int             `json:"queued"`
+	Streams []*activeStream `json:"streams"`
+}
+
+// Snapshot 返回有流式连接或排队请求的key，按key ID排序
+func (t *StreamTracker) Snapshot() []keyStreamsSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]keyStreamsSnapshot, 0, len(t.keys))
+	for id, ks := range t.keys {
+		streams := make([]*activeStream, len(ks.active))
+		for i, s := range ks.active {
+			copied := *s
+			streams[i] = &copied
+		}
+		snapshot = append(snapshot, keyStreamsSnapshot{
+			KeyID:   id,
+			Name:    ks.name,
+			Active:  len(ks.active),
+			Queued:  ks.waiters.Len(),
+			Streams: streams,
+		})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].KeyID < snapshot[j].KeyID })
+	return snapshot
+}
+
+// acquireStreamSlot 为流式请求登记连接，失败时写出错误响应并返回false
+func acquireStreamSlot(w http.ResponseWriter, r *http.Request, key *APIKey, stream *activeStream) (func(), bool) {
+	release, err := streamTracker.Acquire(r.Context(), key, stream)
+	if err == nil {
+		return release, true
+	}
+
+	var limitErr *streamLimitError
+	switch {
+	case errors.As(err, &limitErr):
+		slog.WarnContext(r.Context(), "stream rejected", "key", key.ID, "err", err)
+		writeOpenAIError(w, http.StatusTooManyRequests,
+			fmt.Sprintf("Too many concurrent streams for key %s: limit %d. Close an existing stream and try again.", key.ID, limitErr.limit),
+			"requests", "concurrent_streams_exceeded")
+	case errors.Is(err, errStreamQueueTimeout):
+		slog.WarnContext(r.Context(), "stream rejected", "key", key.ID, "err", err)
+		writeOpenAIError(w, http.StatusTooManyRequests,
+			"Timed out waiting for another stream of this key to finish.", "requests", "concurrent_streams_exceeded")
+	}
+	// 客户端在排队时断开，无需响应
+	return nil, false
+}
+
+// 列出每个key打开的流式连接
+func handleAdminStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"object": "list",
+		"data":   streamTracker.Snapshot(),
+	})
+}
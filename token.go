@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	tokenTTL           = time.Hour        // 登录后token的有效期
+	tokenRefreshBefore = 5 * time.Minute  // 到期前多久在后台主动刷新
+	tokenCheckInterval = 30 * time.Second // 后台检查token有效期的间隔
+)
+
+// 登录上游的次数，包括首次登录、到期前的后台刷新和上游拒绝token后的重新登录，通过 /debug/vars 暴露
+var tokenRefreshes = expvar.NewInt("token_refreshes")
+
+// 全局token管理器，startServer 会按配置替换其存储后端
+var tokenManager = NewTokenManager(&memoryTokenStore{}, loginUpstream)
+
+// TokenManager 在内存中持有上游token并通过TokenStore持久化，可被多个goroutine并发使用。
+// 同一时间最多只有一次登录，并发的调用方共享同一次登录结果
+type TokenManager struct {
+	mu       sync.Mutex
+	token    string
+	expireAt time.Time
+	loaded   bool       // 是否已尝试从存储加载
+	inflight *loginCall // 正在进行的登录
+	store    TokenStore
+	login    func() (string, error)
+}
+
+// 一次正在进行的登录，完成后关闭done
+type loginCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func NewTokenManager(store TokenStore, login func() (string, error)) *TokenManager {
+	return &TokenManager{store: store, login: login}
+}
+
+// Token 返回有效的token，缓存缺失或过期时登录获取
+func (m *TokenManager) Token() (string, error) {
+	m.mu.Lock()
+	if !m.loaded {
+		m.loadLocked()
+	}
+	token := m.token
+	if token != "" && time.Now().Before(m.expireAt) {
+		m.mu.Unlock()
+		return token, nil
+	}
+	m.mu.Unlock()
+
+	return m.Refresh(token)
+}
+
+// Refresh 作废stale并重新登录。若token已被其他调用方换新，直接返回新token，
+// 避免多个并发请求因同一个失效token重复登录
+func (m *TokenManager) Refresh(stale string) (string, error) {
+	m.mu.Lock()
+	if m.token != "" && m.token != stale && time.Now().Before(m.expireAt) {
+		token := m.token
+		m.mu.Unlock()
+		return token, nil
+	}
+	if call := m.inflight; call != nil {
+		m.mu.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+	call := &loginCall{done: make(chan struct{})}
+	m.inflight = call
+	m.mu.Unlock()
+
+	tokenRefreshes.Add(1)
+	call.token, call.err = m.login()
+
+	m.mu.Lock()
+	m.inflight = nil
+	if call.err == nil {
+		m.token = call.token
+		m.expireAt = time.Now().Add(tokenTTL)
+		if err := m.saveLocked(); err != nil {
+			slog.Warn("failed to persist token cache", "err", err)
+		}
+	}
+	m.mu.Unlock()
+	close(call.done)
+
+	return call.token, call.err
+}
+
+// Run 在后台定期检查token，在过期前主动刷新，直到ctx结束
+func (m *TokenManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		token, expireAt := m.token, m.expireAt
+		m.mu.Unlock()
+
+		// 尚未登录过时不主动登录，等第一个请求触发
+		if token == "" || time.Until(expireAt) > tokenRefreshBefore {
+			continue
+		}
+		if _, err := m.Refresh(token); err != nil {
+			slog.Warn("background token refresh failed", "err", err)
+		}
+	}
+}
+
+// 从存储加载缓存的token，调用方需持有锁
+func (m *TokenManager) loadLocked() {
+	m.loaded = true
+
+	cache, err := m.store.Load()
+	if err != nil {
+		slog.Warn("ignoring token cache", "err", err)
+		return
+	}
+	if cache != nil {
+		m.token = cache.Token
+		m.expireAt = cache.ExpireTime
+	}
+}
+
+// 将token写入存储，调用方需持有锁
+func (m *TokenManager) saveLocked() error {
+	return m.store.Save(TokenCache{Token: m.token, ExpireTime: m.expireAt})
+}
+
+// writeFileAtomic 先写入同目录的临时文件再重命名，避免读到写了一半的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
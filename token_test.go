@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 并发获取token时只登录一次，所有调用方拿到同一个token
+func TestTokenManagerSingleFlightLogin(t *testing.T) {
+	refreshesBefore := tokenRefreshes.Value()
+	var logins atomic.Int32
+	release := make(chan struct{})
+	m := NewTokenManager(&memoryTokenStore{}, func() (string, error) {
+		logins.Add(1)
+		<-release
+		return "token-1", nil
+	})
+
+	const n = 50
+	var wg sync.WaitGroup
+	tokens := make([]string, n)
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], errs[i] = m.Token()
+		}()
+	}
+	// 等第一个调用方进入登录后再放行，其余调用方此时应在等待同一次登录
+	waitFor(t, func() bool { return logins.Load() == 1 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := logins.Load(); got != 1 {
+		t.Fatalf("login called %d times, want 1", got)
+	}
+	if got := tokenRefreshes.Value() - refreshesBefore; got != 1 {
+		t.Fatalf("token_refreshes increased by %d, want 1", got)
+	}
+	for i := range n {
+		if errs[i] != nil || tokens[i] != "token-1" {
+			t.Fatalf("caller %d got (%q, %v), want (token-1, nil)", i, tokens[i], errs[i])
+		}
+	}
+}
+
+// 多个请求因同一个失效token同时刷新时只重新登录一次
+func TestTokenManagerRefreshSameStaleToken(t *testing.T) {
+	var logins atomic.Int32
+	m := NewTokenManager(&memoryTokenStore{}, func() (string, error) {
+		n := logins.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		if n == 1 {
+			return "token-1", nil
+		}
+		return "token-2", nil
+	})
+	stale, err := m.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := m.Refresh(stale)
+			if err != nil || token != "token-2" {
+				t.Errorf("Refresh = (%q, %v), want (token-2, nil)", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := logins.Load(); got != 2 {
+		t.Fatalf("login called %d times, want 2 (initial + one refresh)", got)
+	}
+}
+
+// 登录失败时等待的调用方都收到同一个错误，之后的调用会重新登录
+func TestTokenManagerLoginError(t *testing.T) {
+	loginErr := errors.New("bad password")
+	var logins atomic.Int32
+	release := make(chan struct{})
+	m := NewTokenManager(&memoryTokenStore{}, func() (string, error) {
+		if logins.Add(1) == 1 {
+			<-release
+			return "", loginErr
+		}
+		return "token-2", nil
+	})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Token(); !errors.Is(err, loginErr) {
+				t.Errorf("Token err = %v, want %v", err, loginErr)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return logins.Load() == 1 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	token, err := m.Token()
+	if err != nil || token != "token-2" {
+		t.Fatalf("Token after failed login = (%q, %v), want (token-2, nil)", token, err)
+	}
+}
+
+// 启动时从存储加载未过期的token，不需要登录
+func TestTokenManagerLoadsCachedToken(t *testing.T) {
+	store := &memoryTokenStore{}
+	store.Save(TokenCache{Token: "cached", ExpireTime: time.Now().Add(time.Hour)})
+	m := NewTokenManager(store, func() (string, error) {
+		t.Error("login should not be called")
+		return "", nil
+	})
+
+	token, err := m.Token()
+	if err != nil || token != "cached" {
+		t.Fatalf("Token = (%q, %v), want (cached, nil)", token, err)
+	}
+}
+
+// waitFor 轮询直到cond成立，超时则测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// estimateTokens 在本地估算文本的token数。上游不返回用量，这里按常见分词器的规律近似：
+// 汉字、假名、谚文每个字算1个token，连续的字母数字每4个字符算1个token，其余符号各算1个
+func estimateTokens(text string) int {
+	var c tokenCounter
+	c.Write(text)
+	return c.Count()
+}
+
+// tokenCounter 按 estimateTokens 的规则增量估算token数。未结束的单词跨片段累计，
+// 否则每段末尾被拆开的单词都会向上取整，导致流式输出提前截断
+type tokenCounter struct {
+	tokens  int // 已结束部分的token数
+	wordLen int // 未结束单词的长度
+}
+
+func (c *tokenCounter) add(r rune) {
+	switch {
+	case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		c.wordLen++
+	case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+		c.flushWord()
+		c.tokens++
+	case unicode.IsSpace(r):
+		c.flushWord()
+	case unicode.IsLetter(r) || unicode.IsDigit(r):
+		// 其他文字的字母按两个字符一个token处理
+		c.wordLen += 2
+	default:
+		c.flushWord()
+		c.tokens++
+	}
+}
+
+func (c *tokenCounter) flushWord() {
+	c.tokens += (c.wordLen + 3) / 4
+	c.wordLen = 0
+}
+
+// Write 把text计入已输出的文本
+func (c *tokenCounter) Write(text string) {
+	for _, r := range text {
+		c.add(r)
+	}
+}
+
+// Count 返回目前为止的估算token数
+func (c *tokenCounter) Count() int {
+	return c.tokens + (c.wordLen+3)/4
+}
+
+// Truncate 截取text的前缀，使已计入的文本加上前缀的估算token数不超过budget，返回截取结果以及是否发生截断。
+// 只估算新的text，不计入计数，调用方确定最终输出后再 Write
+func (c tokenCounter) Truncate(text string, budget int) (string, bool) {
+	if c.Count() > budget {
+		return "", true
+	}
+	for i, r := range text {
+		c.add(r)
+		if c.Count() > budget {
+			return text[:i], true
+		}
+	}
+	return text, false
+}
+
+// stopFilter 在流式输出中识别停止序列。可能是停止序列开头的尾部文本会暂存，
+// 直到能确定是否命中，因此停止序列被拆在多个片段中时也不会泄露给客户端
+type stopFilter struct {
+	stops []string
+	held  string
+}
+
+func newStopFilter(stops []string) *stopFilter {
+	filtered := make([]string, 0, len(stops))
+	for _, stop := range stops {
+		if stop != "" {
+			filtered = append(filtered, stop)
+		}
+	}
+	return &stopFilter{stops: filtered}
+}
+
+// Push 加入一段输出，返回可以安全发给客户端的文本，以及是否命中了停止序列
+func (f *stopFilter) Push(text string) (string, bool) {
+	if len(f.stops) == 0 {
+		return text, false
+	}
+
+	buf := f.held + text
+	cut := -1
+	for _, stop := range f.stops {
+		if i := strings.Index(buf, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut >= 0 {
+		f.held = ""
+		return buf[:cut], true
+	}
+
+	// 暂存最长的、可能是某个停止序列开头的后缀
+	hold := 0
+	for _, stop := range f.stops {
+		for k := min(len(stop)-1, len(buf)); k > hold; k-- {
+			if strings.HasSuffix(buf, stop[:k]) {
+				hold = k
+				break
+			}
+		}
+	}
+	f.held = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// Flush 流正常结束时返回暂存的文本
+func (f *stopFilter) Flush() string {
+	held := f.held
+	f.held = ""
+	return held
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"hello world", 4},
+		{"你好世界", 4},
+		{"a,b", 3},
+		{"GPT-4", 3},
+		{"こんにちは", 5},
+		{"  \n\t", 0},
+	} {
+		if got := estimateTokens(tc.text); got != tc.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestTokenCounterTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		prev, text  string
+		budget      int
+		want        string
+		wantLimited bool
+	}{
+		{"", "hello world", 10, "hello world", false},
+		{"", "hello world", 4, "hello world", false},
+		{"", "hello world", 3, "hello worl", true},
+		{"", "你好世界", 2, "你好", true},
+		{"", "abc", 0, "", true},
+		// 按累计文本计算：拆开的单词不会在每段都向上取整
+		{"ab", "cd", 1, "cd", false},
+		{"abcd", "ef", 1, "", true},
+		{"abcdef", "gh", 2, "gh", false},
+		{"你好", "世界", 3, "世", true},
+		// 已超出预算（如钩子改写后变长）时不再输出
+		{"abcdefghijkl", "mn", 2, "", true},
+	} {
+		var c tokenCounter
+		c.Write(tc.prev)
+		got, limited := c.Truncate(tc.text, tc.budget)
+		if got != tc.want || limited != tc.wantLimited {
+			t.Errorf("Truncate(%q after %q, %d) = (%q, %v), want (%q, %v)",
+				tc.prev, tc.text, tc.budget, got, limited, tc.want, tc.wantLimited)
+		}
+	}
+}
+
+// 逐段截断的结果应与对完整文本一次截断相同
+func TestTokenCounterTruncateChunked(t *testing.T) {
+	text := "The quick brown fox jumps over the lazy dog, 然后跑掉了。abcdefgh ijklmnop"
+	for budget := 0; budget <= estimateTokens(text)+1; budget++ {
+		for _, size := range []int{1, 2, 3, 5, 8} {
+			var out strings.Builder
+			var counted tokenCounter
+			limited := false
+			for i := 0; i < len(text) && !limited; {
+				end := min(i+size, len(text))
+				for end < len(text) && !isRuneStart(text[end]) {
+					end++
+				}
+				var part string
+				part, limited = counted.Truncate(text[i:end], budget)
+				out.WriteString(part)
+				counted.Write(part)
+				i = end
+			}
+			whole, _ := tokenCounter{}.Truncate(text, budget)
+			if out.String() != whole {
+				t.Fatalf("budget %d, chunk size %d: got %q, want %q", budget, size, out.String(), whole)
+			}
+			if estimateTokens(out.String()) > budget {
+				t.Fatalf("budget %d, chunk size %d: %q exceeds budget", budget, size, out.String())
+			}
+		}
+	}
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func TestStopFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		stops       []string
+		chunks      []string
+		want        string
+		wantStopped bool
+	}{
+		{"no stops", nil, []string{"a", "b"}, "ab", false},
+		{"empty stop ignored", []string{""}, []string{"a", "b"}, "ab", false},
+		{"stop in one chunk", []string{"END"}, []string{"helloENDworld"}, "hello", true},
+		{"stop split across chunks", []string{"END"}, []string{"hello E", "N", "D world"}, "hello ", true},
+		{"partial match released", []string{"END"}, []string{"hello EN", "X"}, "hello ENX", false},
+		{"partial match at end flushed", []string{"END"}, []string{"hello EN"}, "hello EN", false},
+		{"earliest stop wins", []string{"world", "lo"}, []string{"hello world"}, "hel", true},
+		{"overlapping prefixes", []string{"aab"}, []string{"a", "a", "a", "b", "c"}, "a", true},
+		{"stop at start", []string{"\n\n"}, []string{"\n", "\nmore"}, "", true},
+		{"multibyte stop", []string{"。"}, []string{"你好", "。再见"}, "你好", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newStopFilter(tc.stops)
+			var out strings.Builder
+			stopped := false
+			for _, chunk := range tc.chunks {
+				var safe string
+				safe, stopped = f.Push(chunk)
+				out.WriteString(safe)
+				if stopped {
+					break
+				}
+			}
+			if !stopped {
+				out.WriteString(f.Flush())
+			}
+			if out.String() != tc.want || stopped != tc.wantStopped {
+				t.Fatalf("got (%q, %v), want (%q, %v)", out.String(), stopped, tc.want, tc.wantStopped)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TokenStore 上游token的持久化后端
+type TokenStore interface {
+	// Load 返回已保存的token，没有保存过时返回 nil, nil
+	Load() (*TokenCache, error)
+	Save(cache TokenCache) error
+}
+
+// newTokenStore 根据配置创建token存储
+func newTokenStore(cfg TokenStoreConfig, stateDir string) (TokenStore, error) {
+	path := cfg.Path
+	if path == "" {
+		path = filepath.Join(stateDir, "token.json")
+	}
+
+	switch cfg.Type {
+	case "", "file":
+		return &fileTokenStore{path: path}, nil
+	case "memory":
+		return &memoryTokenStore{}, nil
+	case "encrypted_file":
+		keyEnv := cfg.KeyEnv
+		if keyEnv == "" {
+			keyEnv = "ULLM_TOKEN_KEY"
+		}
+		encoded := os.Getenv(keyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("encrypted_file token store requires the %s environment variable", keyEnv)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s must be a base64-encoded 32-byte key (generate one with `openssl rand -base64 32`)", keyEnv)
+		}
+		return newEncryptedFileTokenStore(path, key)
+	default:
+		return nil, fmt.Errorf("unknown token store type %q", cfg.Type)
+	}
+}
+
+// fileTokenStore 以明文JSON保存token
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load() (*TokenCache, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cache TokenCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("invalid token cache %s: %v", s.path, err)
+	}
+	return &cache, nil
+}
+
+func (s *fileTokenStore) Save(cache TokenCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// memoryTokenStore 只在进程内保存token，重启后需要重新登录
+type memoryTokenStore struct {
+	mu    sync.Mutex
+	cache *TokenCache
+}
+
+func (s *memoryTokenStore) Load() (*TokenCache, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		return nil, nil
+	}
+	cache := *s.cache
+	return &cache, nil
+}
+
+func (s *memoryTokenStore) Save(cache TokenCache) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = &cache
+	return nil
+}
+
+// encryptedFileTokenStore 使用AES-256-GCM加密后保存token，
+// 密钥为环境变量中base64编码的32字节随机密钥，不接受口令；文件内容为 nonce || 密文
+type encryptedFileTokenStore struct {
+	path string
+	aead cipher.AEAD
+}
+
+func newEncryptedFileTokenStore(path string, key []byte) (*encryptedFileTokenStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileTokenStore{path: path, aead: aead}, nil
+}
+
+func (s *encryptedFileTokenStore) Load() (*TokenCache, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("encrypted token cache %s is truncated", s.path)
+	}
+	plain, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token cache %s: %v", s.path, err)
+	}
+
+	var cache TokenCache
+	if err := json.Unmarshal(plain, &cache); err != nil {
+		return nil, fmt.Errorf("invalid token cache %s: %v", s.path, err)
+	}
+	return &cache, nil
+}
+
+func (s *encryptedFileTokenStore) Save(cache TokenCache) error {
+	plain, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plain, nil)
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncryptedFileTokenStoreRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Setenv("ULLM_TOKEN_KEY", base64.StdEncoding.EncodeToString(key))
+	path := filepath.Join(t.TempDir(), "token.json")
+
+	store, err := newTokenStore(TokenStoreConfig{Type: "encrypted_file", Path: path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TokenCache{Token: "secret-token", ExpireTime: time.Now().Add(time.Hour).Round(0)}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-token")) {
+		t.Fatal("token written in plaintext")
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Token != want.Token || !got.ExpireTime.Equal(want.ExpireTime) {
+		t.Fatalf("Load = %+v, want %+v", got, want)
+	}
+
+	// 换一个密钥无法解密
+	other := make([]byte, 32)
+	rand.Read(other)
+	wrong, err := newEncryptedFileTokenStore(path, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Load(); err == nil {
+		t.Fatal("Load with the wrong key succeeded")
+	}
+}
+
+func TestEncryptedFileTokenStoreRejectsPassphrase(t *testing.T) {
+	for _, value := range []string{
+		"correct horse battery staple",                         // 口令，不是base64
+		base64.StdEncoding.EncodeToString([]byte("too short")), // 长度不对
+		base64.StdEncoding.EncodeToString(make([]byte, 16)),    // AES-128 长度的密钥
+	} {
+		t.Setenv("ULLM_TOKEN_KEY", value)
+		if _, err := newTokenStore(TokenStoreConfig{Type: "encrypted_file"}, t.TempDir()); err == nil {
+			t.Errorf("newTokenStore accepted ULLM_TOKEN_KEY=%q", value)
+		}
+	}
+
+	t.Setenv("ULLM_TOKEN_KEY", "")
+	if _, err := newTokenStore(TokenStoreConfig{Type: "encrypted_file"}, t.TempDir()); err == nil {
+		t.Error("newTokenStore accepted an empty key")
+	}
+}
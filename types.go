@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
 
 // 认证相关结构体
 type LoginRequest struct {
@@ -27,13 +31,32 @@ type ChatCompletionsRequest struct {
 		Role    string `json:"role"`
 		Content any    `json:"content"`
 	} `json:"messages"`
-	Temperature   *float64 `json:"temperature,omitempty"`
-	Stream        *bool    `json:"stream,omitempty"`
+	Temperature   *float64      `json:"temperature,omitempty"`
+	MaxTokens     *int          `json:"max_tokens,omitempty"`
+	Stop          StopSequences `json:"stop,omitempty"`
+	Stream        *bool         `json:"stream,omitempty"`
 	StreamOptions *struct {
 		IncludeUsage bool `json:"include_usage,omitempty"`
 	} `json:"stream_options,omitempty"`
 }
 
+// StopSequences 停止序列，请求中可以是单个字符串或字符串数组
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = StopSequences{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
@@ -78,6 +101,7 @@ type ChatCompletionChunk struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"` // 仅在 stream_options.include_usage 的最后一个块中出现
 }
 
 // 模型相关结构体
@@ -90,35 +114,39 @@ type Model struct {
 
 // ModelConfig 模型配置信息
 type ModelConfig struct {
-	ID      string
-	APIID   string // API中使用的modelId
-	Object  string
-	Created int64
-	OwnedBy string
+	ID        string
+	APIID     string // API中使用的modelId
+	Object    string
+	Created   int64
+	OwnedBy   string
+	Fallbacks []string // 上游失败或返回空回答时按顺序尝试的备用模型ID
 }
 
 // 统一的模型配置
 var ModelConfigs = []ModelConfig{
 	{
-		ID:      "qwen",
-		APIID:   "1",
-		Object:  "model",
-		Created: 1677610602,
-		OwnedBy: "ulearning",
+		ID:        "qwen",
+		APIID:     "1",
+		Object:    "model",
+		Created:   1677610602,
+		OwnedBy:   "ulearning",
+		Fallbacks: []string{"doubao"},
 	},
 	{
-		ID:      "doubao",
-		APIID:   "2",
-		Object:  "model",
-		Created: 1687882411,
-		OwnedBy: "ulearning",
+		ID:        "doubao",
+		APIID:     "2",
+		Object:    "model",
+		Created:   1687882411,
+		OwnedBy:   "ulearning",
+		Fallbacks: []string{"qwen"},
 	},
 	{
-		ID:      "deepseek-r1",
-		APIID:   "3",
-		Object:  "model",
-		Created: 1712361441,
-		OwnedBy: "ulearning",
+		ID:        "deepseek-r1",
+		APIID:     "3",
+		Object:    "model",
+		Created:   1712361441,
+		OwnedBy:   "ulearning",
+		Fallbacks: []string{"deepseek-r1-local", "deepseek-v3.1"},
 	},
 	{
 		ID:      "qwen2.5-vl-7b",
@@ -128,18 +156,20 @@ var ModelConfigs = []ModelConfig{
 		OwnedBy: "ulearning",
 	},
 	{
-		ID:      "deepseek-r1-local",
-		APIID:   "6",
-		Object:  "model",
-		Created: 1712361441,
-		OwnedBy: "ulearning",
+		ID:        "deepseek-r1-local",
+		APIID:     "6",
+		Object:    "model",
+		Created:   1712361441,
+		OwnedBy:   "ulearning",
+		Fallbacks: []string{"deepseek-r1", "deepseek-v3.1"},
 	},
 	{
-		ID:      "deepseek-v3.1",
-		APIID:   "7",
-		Object:  "model",
-		Created: 1712361441,
-		OwnedBy: "ulearning",
+		ID:        "deepseek-v3.1",
+		APIID:     "7",
+		Object:    "model",
+		Created:   1712361441,
+		OwnedBy:   "ulearning",
+		Fallbacks: []string{"deepseek-r1", "doubao"},
 	},
 }
 
@@ -153,6 +183,33 @@ func GetModelAPIID(modelID string) string {
 	return "2" // 默认使用豆包
 }
 
+// ModelExists 模型ID是否在配置中
+func ModelExists(modelID string) bool {
+	for _, config := range ModelConfigs {
+		if config.ID == modelID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetModelChain 返回请求模型及其备用模型组成的尝试顺序
+func GetModelChain(modelID string) []string {
+	chain := []string{modelID}
+	for _, config := range ModelConfigs {
+		if config.ID != modelID {
+			continue
+		}
+		for _, fallback := range config.Fallbacks {
+			if !slices.Contains(chain, fallback) {
+				chain = append(chain, fallback)
+			}
+		}
+		break
+	}
+	return chain
+}
+
 // GetAvailableModels 获取可用模型列表
 func GetAvailableModels() []Model {
 	models := make([]Model, len(ModelConfigs))
@@ -226,9 +283,10 @@ type ResponsesInputMessage struct {
 }
 
 type ResponsesRequest struct {
-	Model  string      `json:"model"`
-	Input  interface{} `json:"input"` // 可以是字符串或 []ResponsesInputMessage
-	Stream *bool       `json:"stream,omitempty"`
+	Model           string      `json:"model"`
+	Input           interface{} `json:"input"` // 可以是字符串或 []ResponsesInputMessage
+	MaxOutputTokens *int        `json:"max_output_tokens,omitempty"`
+	Stream          *bool       `json:"stream,omitempty"`
 }
 
 type ResponsesOutputContent struct {
@@ -265,12 +323,12 @@ type ResponsesStreamChunk struct {
 
 // Completions API 相关结构体
 type CompletionsRequest struct {
-	Model         string   `json:"model"`
-	Prompt        string   `json:"prompt"`
-	MaxTokens     *int     `json:"max_tokens,omitempty"`
-	Temperature   *float64 `json:"temperature,omitempty"`
-	Stop          []string `json:"stop,omitempty"`
-	Stream        *bool    `json:"stream,omitempty"`
+	Model         string        `json:"model"`
+	Prompt        string        `json:"prompt"`
+	MaxTokens     *int          `json:"max_tokens,omitempty"`
+	Temperature   *float64      `json:"temperature,omitempty"`
+	Stop          StopSequences `json:"stop,omitempty"`
+	Stream        *bool         `json:"stream,omitempty"`
 	StreamOptions *struct {
 		IncludeUsage bool `json:"include_usage,omitempty"`
 	} `json:"stream_options,omitempty"`
@@ -304,6 +362,7 @@ type CompletionsStreamChunk struct {
 	Created int64                     `json:"created"`
 	Model   string                    `json:"model"`
 	Choices []CompletionsStreamChoice `json:"choices"`
+	Usage   *Usage                    `json:"usage,omitempty"`
 }
 
 // 统一的流式响应格式
@@ -311,4 +370,5 @@ type UnifiedStreamChunk struct {
 	ID    string `json:"id"`
 	Type  string `json:"type"`            // "response.output_text.delta" 或 "response.completed"
 	Delta string `json:"delta,omitempty"` // 增量文本内容，仅在 delta 类型时存在
+	Usage *Usage `json:"usage,omitempty"` // 估算的用量，仅在 completed 类型时存在
 }